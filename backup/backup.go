@@ -3,21 +3,28 @@ package backup
 import (
 	"cliback/config"
 	"cliback/database"
+	"cliback/report"
 	"cliback/status"
 	"cliback/transport"
 	"cliback/workerpool"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func FindFiles(jobsChan chan<- workerpool.TaskElem, tInfo database.TableInfo) {
+// FindFiles walk shadow of table freeze and send files for backup
+func FindFiles(ctx context.Context, tInfo database.TableInfo, shadowName string, skipParts map[string]bool, send func(transport.CliFile)) {
 	c := config.New()
 	for storage := range c.ClickhouseStorage {
-		dirForBackup := c.GetShadow(storage)
+		dirForBackup := c.GetShadow(storage, shadowName)
 		st, err := os.Stat(dirForBackup)
 		if err != nil {
 			continue
@@ -25,11 +32,23 @@ func FindFiles(jobsChan chan<- workerpool.TaskElem, tInfo database.TableInfo) {
 		if !st.IsDir() {
 			continue
 		}
+		if _, ok := c.ObjectDisks[storage]; c.IsObjectDisk(storage) && !ok {
+			log.Printf("Table `%s`.`%s` has data on %s disk %s without object_disks connection, skip it",
+				tInfo.DBName, tInfo.TableName, c.ClickhouseDiskTypes[storage], storage)
+			s := status.New()
+			s.SetStatus(status.FailBackupTable)
+			report.New().Error(tInfo.DBName, tInfo.TableName, "disk "+storage,
+				errors.New("Object disk connection not set"))
+			continue
+		}
 		err = filepath.Walk(dirForBackup,
 			func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return err
 				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
 				if info.IsDir() {
 					return nil
 				}
@@ -37,6 +56,9 @@ func FindFiles(jobsChan chan<- workerpool.TaskElem, tInfo database.TableInfo) {
 				if err != nil {
 					return nil
 				}
+				if skipParts[PartDir(cPath[2])] {
+					return nil
+				}
 				cliF := transport.CliFile{
 					Name:       cPath[2],
 					Path:       cPath[1],
@@ -47,97 +69,137 @@ func FindFiles(jobsChan chan<- workerpool.TaskElem, tInfo database.TableInfo) {
 					TryRetry:   false,
 					Storage:    storage,
 				}
+				if !c.IsObjectDisk(storage) {
+					// Parts are immutable, name+size+mtime identify content for stat cache
+					cliF.Size = info.Size()
+					cliF.MTime = info.ModTime().Unix()
+				}
 				log.Printf("Backup  From %s Archive: %s", cliF.BackupSrcShort(), cliF.Archive())
-				jobsChan <- cliF
+				send(cliF)
 				return nil
 			})
+		if err == context.Canceled {
+			break
+		}
 		if err != nil {
 			log.Println(err)
 			s := status.New()
 			s.SetStatus(status.FailBackupTable)
+			report.New().Error(tInfo.DBName, tInfo.TableName, dirForBackup, err)
 		}
 	}
-	close(jobsChan)
 }
 
+// checkStatCache match unchanged file with reference chain without reading it
+func checkStatCache(cf transport.CliFile) (transport.CliFile, bool) {
+	c := config.New()
+	if c.RehashFiles || cf.MTime == 0 {
+		return cf, false
+	}
+	ref, ok := GetPreviousBackups().LookupStat(path.Join(cf.DBName, cf.TableName, cf.Name), cf.Size, cf.MTime)
+	if !ok {
+		return cf, false
+	}
+	cf.Sha1 = ref.Sha1
+	cf.Reference = ref.Backup
+	if ref.Path != path.Join(cf.DBName, cf.TableName, cf.Name) {
+		cf.RefPath = ref.Path
+	}
+	cf.Size = ref.Size
+	cf.BSize = ref.BSize
+	return cf, true
+}
+
+// CheckForReference search file content in previous backups by sha1 and size
 func CheckForReference(cf transport.CliFile) transport.CliFile {
 	pbs := GetPreviousBackups()
-	c := config.New()
-	for _, pb := range pbs.backupInfos {
-		cfOld := pb.DBS[c.TaskArgs.DBNow].Tables[c.TaskArgs.TableNow].Files[cf.Name]
-		if len(cfOld.Reference) > 0 {
-			continue
-		}
-		if cfOld.Sha1 == cf.Sha1 {
-			cf.Reference = pb.Name
-			cf.Size = cfOld.Size
-			cf.BSize = cfOld.BSize
-			return cf
-		}
+	ref, ok := pbs.Lookup(cf.Sha1, cf.Size)
+	if !ok {
+		return cf
 	}
+	cf.Reference = ref.Backup
+	if ref.Path != path.Join(cf.DBName, cf.TableName, cf.Name) {
+		cf.RefPath = ref.Path
+	}
+	cf.Size = ref.Size
+	cf.BSize = ref.BSize
 	return cf
 }
 
-// BackupRun This func Running in Worker Pool
-func BackupRun(cf transport.CliFile) (transport.CliFile, error) {
+// BackupRun This func Running in Worker Pool, one attempt, pool retries it
+func BackupRun(ctx context.Context, cf transport.CliFile, db, table string) (transport.CliFile, error) {
 	c := config.New()
-	for {
-		if c.TaskArgs.BackupType == "diff" ||
-			c.TaskArgs.BackupType == "incr" {
-			err := cf.Sha1Compute()
-			if err != nil {
-				if err == os.ErrNotExist {
-					log.Printf("File not Exists %s %s", err, cf.BackupSrc())
-					s := status.New()
-					s.SetStatus(status.FailBackupFile)
-					return cf, err
-				}
-				log.Printf("Error open shadow file %s Retry. Err: %v", cf.BackupSrc(), err)
-				time.Sleep(time.Second * 5)
-				continue
-			}
-			cf = CheckForReference(cf)
-			if len(cf.Reference) > 0 {
-				return cf, nil
-			}
+	if ctx.Err() != nil {
+		return cf, ctx.Err()
+	}
+	if c.TaskArgs.BackupType == "diff" ||
+		c.TaskArgs.BackupType == "incr" {
+		if ref, ok := checkStatCache(cf); ok {
+			return ref, nil
 		}
-		tr, err := transport.MakeTransport()
+		err := cf.Sha1Compute(ctx)
 		if err != nil {
+			log.Printf("Error read shadow file %s: %v", cf.BackupSrc(), err)
 			return cf, err
 		}
-		trStat, err := tr.Do(cf)
-		if err != nil {
-			if err == os.ErrNotExist {
-				log.Printf("File not Exists %s %s", err, cf.BackupSrc())
-				s := status.New()
-				s.SetStatus(status.FailBackupFile)
-				return cf, err
-			}
-			log.Printf("Error open shadow file %s Retry. Err: %v", cf.BackupSrc(), err)
-			time.Sleep(time.Second * 5)
-			continue
+		cf = CheckForReference(cf)
+		if len(cf.Reference) > 0 {
+			return cf, nil
+		}
+	}
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return cf, workerpool.Permanent(err)
+	}
+	trStat, err := tr.Do(ctx, cf)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Backup file %s aborted", cf.BackupSrc())
+			return cf, ctx.Err()
 		}
-		cf.Sha1 = trStat.Sha1Sum
-		cf.Size = trStat.Size
-		cf.BSize = trStat.BSize
-		return cf, nil
+		log.Printf("Error backup file %s: %v", cf.BackupSrc(), err)
+		return cf, err
 	}
+	cf.Sha1 = trStat.Sha1Sum
+	cf.Size = trStat.Size
+	cf.BSize = trStat.BSize
+	return cf, nil
 }
 
-func Backup() error {
+// Backup make backup, on ctx cancel stop new files and mark backup as cancelled
+func Backup(ctx context.Context) error {
 	// Main backup loop
-	retentionBeforeBackup()
 	c := config.New()
 	ch := database.New()
 	ch.SetDSN(c.ClickhouseBackupConn)
+	ch.SetContext(ctx)
+	if len(c.ClusterName) > 0 {
+		if err := checkClusterJobName(c.TaskArgs.JobName); err != nil {
+			return err
+		}
+		selected, err := setupCluster(c.ClickhouseBackupConn)
+		if err != nil {
+			return err
+		}
+		if !selected {
+			log.Printf("Cluster: other replica make backup of %s, skip", c.TaskArgs.ShardDir)
+			return nil
+		}
+	}
+	retentionBeforeBackup()
 	err := CheckStorage()
 	if err != nil {
 		return err
 	}
+	startupCleanup(ctx)
 	backupObjects, err := getBackupObjects()
 	if err != nil {
 		return err
 	}
+	err = checkBackupSpace(backupObjects)
+	if err != nil {
+		return err
+	}
 
 	if len(c.TaskArgs.JobName) < 1 {
 		c.TaskArgs.JobName = GenerateBackupName()
@@ -148,10 +210,17 @@ func Backup() error {
 		Name:         c.TaskArgs.JobName,
 		Type:         c.TaskArgs.BackupType,
 		Version:      1,
+		Cluster:      c.ClusterName,
+		Shard:        c.TaskArgs.ShardDir,
+		Status:       BackupStatusRunning,
 		BackupFilter: backupObjects,
 		StartDate:    GetFormatedTime(),
 		DBS:          map[string]databaseInfo{},
 	}
+	bi.Server, err = getServerInfo()
+	if err != nil {
+		log.Printf("Get server info error: %v", err)
+	}
 	if c.TaskArgs.BackupType == "diff" ||
 		c.TaskArgs.BackupType == "incr" {
 		pbs := GetPreviousBackups()
@@ -161,33 +230,35 @@ func Backup() error {
 		}
 		log.Printf("Search delta by backups: %s", pbs.GetBackupNames())
 	}
-	for db, tables := range backupObjects {
-		c.TaskArgs.DBNow = db
-		di := databaseInfo{
-			Tables:   map[string]tableInfo{},
-			MetaData: map[string]fileInfo{},
-		}
-		for _, table := range tables {
-			log.Printf("Backup table: `%s`.`%s`", db, table)
-			c.TaskArgs.TableNow = table
-			var ti tableInfo
-			if c.TaskArgs.BackupType == "part" {
-				ti, _ = backupTable(db, table, c.TaskArgs.JobPartition)
-			} else {
-				ti, _ = backupTable(db, table, "")
-			}
-			di.Tables[table] = ti
-			// Added for backward compatibility
-			di.MetaData[table] = ti.MetaData
-			di.Add(&ti)
-		}
-		bi.DBS[db] = di
-		bi.Add(&di)
-		bi.StopDate = GetFormatedTime()
-		err = BackupInfoWrite(&bi)
+	err = BackupInfoWrite(ctx, &bi)
+	if err != nil {
+		log.Printf("Write backup info error: %v", err)
+	}
+	backupTables(ctx, &bi, backupObjects)
+	bi.StopDate = GetFormatedTime()
+	if ctx.Err() != nil {
+		log.Printf("Backup %s cancelled", bi.Name)
+		bi.Results = report.New().Issues()
+		bi.Status = BackupStatusCancelled
+		err = BackupInfoWrite(ctx, &bi)
 		if err != nil {
 			log.Printf("Write backup info error: %v", err)
 		}
+		return ctx.Err()
+	}
+	bi.Results = report.New().Issues()
+	bi.Status = resultStatus(bi.Results)
+	err = BackupInfoWrite(ctx, &bi)
+	if err != nil {
+		return err
+	}
+	if bi.Status != BackupStatusComplete {
+		log.Print("Backup info:\n" + bi.String())
+		return errors.New("Backup has failed objects, marked as failed")
+	}
+	err = writeCompleteMarker(&bi)
+	if err != nil {
+		return err
 	}
 	log.Print("Backup info:\n" + bi.String())
 	return nil
@@ -217,10 +288,22 @@ func backupMeta(tInfo database.TableInfo) (transport.MetaFile, error) {
 	return mf, err
 }
 
-func backupTable(db, table, part string) (tableInfo, error) {
-	c := config.New()
+// schemaOnly backup type schema: DDL of all objects without data
+func schemaOnly() bool {
+	return config.New().TaskArgs.BackupType == "schema"
+}
+
+// backupTable freeze table and send files into shared file pool, wait files of table
+func backupTable(ctx context.Context, jobsChan chan<- workerpool.TaskElem, budget *shadowBudget, db, table string) (tableInfo, error) {
 	ch := database.New()
-	parts, err := ch.GetPartitions(db, table, part)
+	var parts, ids []string
+	var err error
+	selector := tablePartitionSelector(db, table)
+	if len(selector) > 0 {
+		parts, ids, err = selectPartitions(db, table, selector)
+	} else if !schemaOnly() {
+		parts, err = ch.GetPartitions(db, table, "")
+	}
 	if err != nil {
 		return tableInfo{BackupStatus: "bad"}, err
 	}
@@ -232,6 +315,8 @@ func backupTable(db, table, part string) (tableInfo, error) {
 		DbDir:        tInfo.GetDBNameE(),
 		TableDir:     tInfo.GetTableNameE(),
 		Partitions:   parts,
+		Selector:     selector,
+		Policy:       tInfo.StoragePolicy,
 		Files:        map[string]fileInfo{},
 		BackupStatus: "bad",
 	}
@@ -243,45 +328,119 @@ func backupTable(db, table, part string) (tableInfo, error) {
 	} else {
 		s := status.New()
 		s.SetStatus(status.FailBackupMeta)
+		report.New().Error(db, table, mf.Name, err)
+	}
+	if schemaOnly() {
+		if err != nil {
+			return ti, err
+		}
+		ti.BackupStatus = "OK"
+		return ti, nil
+	}
+	if len(selector) > 0 && len(ids) < 1 {
+		log.Printf("Table `%s`.`%s` no partitions for selector `%s`", db, table, selector)
+		ti.BackupStatus = "OK"
+		return ti, nil
 	}
-	err = ch.FreezeTable(db, table, part)
+	err = budget.acquire(db, table)
 	if err != nil {
-		s := status.New()
-		s.SetStatus(status.FailFreezeTable)
-		return tableInfo{BackupStatus: "bad"}, err
+		return tableInfo{BackupStatus: BackupStatusCancelled}, err
 	}
-	time.Sleep(time.Second * 1) /// Clickhouse after freeze need some time
-	c.ShadowDirIncr, err = ch.GetIncrement()
+	defer budget.release(db, table)
+	if partStrategy() {
+		ti.Parts = tableParts(db, table)
+	}
+	shadowName, err := freezeTable(db, table, ids)
 	if err != nil {
-		s := status.New()
-		s.SetStatus(status.FailGetIncrement)
 		return tableInfo{BackupStatus: "bad"}, err
 	}
-	defer RemoveShadowDirs()
-	ti.Dirs = GetDirsInShadow(tInfo)
-	var wpTask workerpool.TaskFunc = func(i interface{}) (interface{}, error) {
-		field, _ := i.(transport.CliFile)
-		return BackupRun(field)
-	}
+	defer RemoveShadowDirs(shadowName)
+	ti.Dirs = GetDirsInShadow(tInfo, shadowName)
+	skipParts := reuseParts(&ti, db, table)
 
-	wp := workerpool.MakeWorkerPool(wpTask, c.WorkerPool.NumWorkers, c.WorkerPool.NumRetry, c.WorkerPool.ChanLen)
-	wp.Start()
-	go FindFiles(wp.GetJobsChan(), tInfo)
-
-	for job := range wp.GetResultsChan() {
-		j, _ := job.(transport.CliFile)
-		ti.AddJob(&j)
+	tj := &tableJob{db: db, table: table, ti: ti}
+	FindFiles(ctx, tInfo, shadowName, skipParts, func(cf transport.CliFile) {
+		tj.wg.Add(1)
+		jobsChan <- &fileJob{cf: cf, table: tj}
+	})
+	tj.wg.Wait()
+	ti = tj.ti
+	if ctx.Err() != nil {
+		ti.BackupStatus = BackupStatusCancelled
+		return ti, ctx.Err()
 	}
 	ti.BackupStatus = "OK"
 	return ti, nil
 }
 
+var freezeMux sync.Mutex
+
+// freezeByName freeze table or partitions by ids into shadow/<name>
+func freezeByName(db, table string, ids []string, name string) error {
+	ch := database.New()
+	if len(ids) < 1 {
+		return ch.FreezeTableWithName(db, table, "", name)
+	}
+	for _, id := range ids {
+		err := ch.FreezePartitionID(db, table, id, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// freezeTable freeze table or partitions by ids with name, fallback to shadow/increment.txt
+// on old servers rejecting WITH NAME. Returns shadow dir name of freeze
+func freezeTable(db, table string, ids []string) (string, error) {
+	c := config.New()
+	ch := database.New()
+	name := ShadowName(c.TaskArgs.JobName, db, table)
+	err := freezeByName(db, table, ids, name)
+	if err == nil {
+		return name, nil
+	}
+	RemoveShadowDirs(name)
+	// only old servers without WITH NAME fallback, other errors are freeze failures
+	if len(ids) > 1 || !database.IsUnsupported(err) {
+		s := status.New()
+		s.SetStatus(status.FailFreezeTable)
+		return "", err
+	}
+	log.Printf("Freeze with name `%s`.`%s` error: %v, use shadow increment", db, table, err)
+	// increment.txt is shared, freeze and read it one table at a time
+	freezeMux.Lock()
+	defer freezeMux.Unlock()
+	if len(ids) == 1 {
+		err = ch.FreezePartitionID(db, table, ids[0], "")
+	} else {
+		err = ch.FreezeTable(db, table, "")
+	}
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailFreezeTable)
+		return "", err
+	}
+	time.Sleep(time.Second * 1) /// Clickhouse after freeze need some time
+	incr, err := ch.GetIncrement()
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailGetIncrement)
+		return "", err
+	}
+	return strconv.Itoa(incr), nil
+}
+
 func getBackupObjects() (map[string][]string, error) {
 	backupObjects := map[string][]string{}
 	c := config.New()
 	backupFilter := c.BackupFilter
 	ch := database.New()
-	currentDBS, err := ch.GetDBS()
+	getDBS, getTables := ch.GetDBS, ch.GetTables
+	if schemaOnly() {
+		getDBS, getTables = ch.GetAllDBS, ch.GetAllTables
+	}
+	currentDBS, err := getDBS()
 	if err != nil {
 		s := status.New()
 		s.SetStatus(status.FailGetDBS)
@@ -291,7 +450,7 @@ func getBackupObjects() (map[string][]string, error) {
 		if db == "system" {
 			continue
 		}
-		currentTables, err := ch.GetTables(db)
+		currentTables, err := getTables(db)
 		if err != nil {
 			s := status.New()
 			s.SetStatus(status.FailGetTables)
@@ -300,37 +459,44 @@ func getBackupObjects() (map[string][]string, error) {
 		//clone slice
 		backupObjects[db] = append(currentTables[:0:0], currentTables...)
 	}
-	if backupFilter == nil {
-		return backupObjects, nil
-	}
-	for db, tables := range backupFilter {
-		if _, ok := backupObjects[db]; !ok {
-			return nil, errors.New("Bad filter, not contains in database")
-		}
-		if tables == nil {
-			backupFilter[db] = backupObjects[db]
+	// exact names must exist, patterns may match nothing
+	for pdb, tables := range backupFilter {
+		if isPattern(pdb) {
 			continue
 		}
+		if _, ok := backupObjects[pdb]; !ok {
+			return nil, errors.New("Bad filter, not contains in database")
+		}
 		for _, table := range tables {
-			if !Contains(backupObjects[db], table) {
+			if !isPattern(table) && !Contains(backupObjects[pdb], table) {
 				return nil, errors.New("Bad filter, not contains in database")
 			}
 		}
 	}
-	if c.TaskArgs.BackupType == "part" {
-		if len(backupFilter) != 1 {
-			return backupFilter, errors.New("Bad backup filter for parted mode, set only one db.table")
+	result := map[string][]string{}
+	for db, tables := range backupObjects {
+		if !filterMatch(backupFilter, c.BackupExclude, db, "") {
+			continue
 		}
-		for _, tables := range backupFilter {
-			if len(tables) != 1 {
-				return backupFilter, errors.New("Bad backup filter for parted mode, set only one db.table")
+		var selected []string
+		for _, table := range tables {
+			if filterMatch(backupFilter, c.BackupExclude, db, table) {
+				selected = append(selected, table)
 			}
 		}
+		if len(selected) < 1 && backupFilter != nil {
+			log.Printf("Backup filter: no tables of database %s matched", db)
+			continue
+		}
+		result[db] = selected
+	}
+	if len(result) < 1 && backupFilter != nil {
+		return nil, errors.New("Backup filter matched no databases")
 	}
-	return backupFilter, nil
+	return result, nil
 }
 
-func BackupInfoWrite(bi *backupInfo) error {
+func BackupInfoWrite(ctx context.Context, bi *backupInfo) error {
 	c := config.New()
 	prepareBytes, err := json.MarshalIndent(bi, "", "  ")
 	if err != nil {
@@ -341,28 +507,30 @@ func BackupInfoWrite(bi *backupInfo) error {
 		s.SetStatus(status.FailBackupMeta)
 		return err
 	}
-	mf := transport.MetaFile{
-		Name:     "backup.json",
-		Path:     "",
-		JobName:  c.TaskArgs.JobName,
-		TryRetry: false,
-		Sha1:     "",
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return err
 	}
 	for _, s := range []string{".copy", ""} {
-		for {
+		mf := transport.MetaFile{
+			Name:     "backup.json" + s,
+			Path:     "",
+			JobName:  c.TaskArgs.JobName,
+			TryRetry: false,
+			Sha1:     "",
+		}
+		err = workerpool.Retry(ctx, func() error {
+			// content consumed by write, set once per attempt
+			mf.Content.Reset()
 			mf.Content.Write(prepareBytes)
-			mf.Name = "backup.json" + s
-			tr, err := transport.MakeTransport()
-			if err != nil {
-				return err
-			}
-			err = tr.WriteMeta(&mf)
+			err := tr.WriteMeta(&mf)
 			if err != nil {
-				log.Println("Error write metafile ", mf.Path)
-				time.Sleep(time.Second * 5)
-				continue
+				return fmt.Errorf("Error write metafile %s: %w", mf.Name, err)
 			}
-			break
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 	}
 	return nil
@@ -1,37 +1,39 @@
 package backup
 
 import (
-	"bytes"
 	"cliback/config"
 	"cliback/transport"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
+	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 func checkBackupType(bi *backupInfo) error {
 	if len(bi.BackupFilter) < 1 {
-		errors.New("BackupFilter not parsed")
+		return errors.New("BackupFilter not parsed")
 	}
 	if len(bi.Name) < 1 {
-		errors.New("Name not parsed")
+		return errors.New("Name not parsed")
 	}
 	if len(bi.Type) < 1 {
-		errors.New("Type not parsed")
+		return errors.New("Type not parsed")
 	}
 	if bi.BSize < 1 {
-		errors.New("BSize not parsed")
+		return errors.New("BSize not parsed")
 	}
 	if bi.Size < 1 {
-		errors.New("Size not parsed")
+		return errors.New("Size not parsed")
 	}
 	if bi.RepoSize < 1 {
-		errors.New("RepoSize not parsed")
+		return errors.New("RepoSize not parsed")
 	}
 	if bi.RepoBSize < 1 {
-		errors.New("RepoBSize not parsed")
+		return errors.New("RepoBSize not parsed")
 	}
 	return nil
 }
@@ -40,41 +42,163 @@ func TestBackupRead(t *testing.T) {
 	bi := new(backupInfo)
 	jFile, err := ioutil.ReadFile("test_backup_v1.json")
 	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
+		t.Skipf("test backup info not found: %v", err)
 	}
 	err = json.Unmarshal(jFile, bi)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
+		t.Fatalf("Unmarshal: %v", err)
 	}
 	err = checkBackupType(bi)
 	if err != nil {
 		t.Error(err.Error())
 	}
-	return
 }
 
 func TestMetaTransportLocalRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 	c := config.New()
-	c.BackupStorage.BackupDir = "/home/dro/go-1.13/src/cliback/backup"
-	bi := new(backupInfo)
-	mf := transport.MetaFile{
-		Name:     "Test",
-		Path:     "test_backup_v1.json",
-		TryRetry: false,
-		Sha1:     "",
-		Content:  bytes.Buffer{},
-	}
-	err := transport.ReadMetaLocal(&mf)
+	defer func(storage string, backupDir string) {
+		c.BackupStorage.Type, c.BackupStorage.BackupDir = storage, backupDir
+	}(c.BackupStorage.Type, c.BackupStorage.BackupDir)
+	c.BackupStorage.Type = "local"
+	c.BackupStorage.BackupDir = dir
+
+	src := backupInfo{
+		counter:      counter{Size: 10, BSize: 5, RepoSize: 10, RepoBSize: 5},
+		Name:         "20210101_000000F",
+		Type:         "full",
+		Version:      1,
+		BackupFilter: map[string][]string{"db": {"t"}},
+	}
+	content, err := json.Marshal(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := transport.MakeTransport()
 	if err != nil {
-		t.Error("Error read metafile")
+		t.Fatal(err)
+	}
+	mf := transport.MetaFile{Name: "backup.json", JobName: src.Name}
+	mf.Content.Write(content)
+	if err := tr.WriteMeta(&mf); err != nil {
+		t.Fatalf("Error write metafile: %v", err)
+	}
+	rf := transport.MetaFile{Name: "backup.json", JobName: src.Name}
+	if err := tr.ReadMeta(&rf); err != nil {
+		t.Fatalf("Error read metafile: %v", err)
 	}
-	err = json.Unmarshal(mf.Content.Bytes(), bi)
+	bi := new(backupInfo)
+	err = json.Unmarshal(rf.Content.Bytes(), bi)
 	if err != nil {
-		t.Errorf("Unmarshal: %v", err)
+		t.Fatalf("Unmarshal: %v", err)
 	}
 	err = checkBackupType(bi)
 	if err != nil {
 		t.Error(err.Error())
 	}
-	return
+}
+
+func TestSchemaBackupNameSearched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.New()
+	defer func(storage, backupDir, backupType string) {
+		c.BackupStorage.Type, c.BackupStorage.BackupDir, c.TaskArgs.BackupType = storage, backupDir, backupType
+	}(c.BackupStorage.Type, c.BackupStorage.BackupDir, c.TaskArgs.BackupType)
+	c.BackupStorage.Type = "local"
+	c.BackupStorage.BackupDir = dir
+	c.TaskArgs.BackupType = "schema"
+
+	name := GenerateBackupName()
+	if err := os.Mkdir(path.Join(dir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metas, err := tr.SearchMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Contains(metas, name) {
+		t.Errorf("schema backup %s not found: %v", name, metas)
+	}
+}
+
+func TestClusterJobName(t *testing.T) {
+	c := config.New()
+	defer func(backupType string) { c.TaskArgs.BackupType = backupType }(c.TaskArgs.BackupType)
+	c.TaskArgs.BackupType = "full"
+	if err := checkClusterJobName(""); err == nil {
+		t.Error("empty cluster job name accepted")
+	}
+	if err := checkClusterJobName("20210101_000000D"); err == nil {
+		t.Error("job name of other backup type accepted")
+	}
+	if err := checkClusterJobName("nightly"); err == nil {
+		t.Error("job name not in YYYYMMDD_HHMMSS<type> format accepted")
+	}
+	if err := checkClusterJobName("20210101_000000F"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShadowNameUnique(t *testing.T) {
+	pairs := [][2][2]string{
+		{{"db_a", "b"}, {"db", "a_b"}},
+		{{"a.b", "c"}, {"a", "b.c"}},
+		{{"db", "t-1"}, {"db", "t_1"}},
+	}
+	for _, p := range pairs {
+		a := ShadowName("20210101_000000F", p[0][0], p[0][1])
+		b := ShadowName("20210101_000000F", p[1][0], p[1][1])
+		if a == b {
+			t.Errorf("%v and %v have same shadow name %s", p[0], p[1], a)
+		}
+	}
+}
+
+func TestBackupInfoWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.New()
+	defer func(storage, backupDir, jobName string) {
+		c.BackupStorage.Type, c.BackupStorage.BackupDir, c.TaskArgs.JobName = storage, backupDir, jobName
+	}(c.BackupStorage.Type, c.BackupStorage.BackupDir, c.TaskArgs.JobName)
+	c.BackupStorage.Type = "local"
+	c.BackupStorage.BackupDir = dir
+	c.TaskArgs.JobName = "20210101_000000F"
+
+	bi := backupInfo{Name: "20210101_000000F", Type: "full", Status: BackupStatusComplete}
+	if err := BackupInfoWrite(context.Background(), &bi); err != nil {
+		t.Fatal(err)
+	}
+	read, err := BackupRead("20210101_000000F")
+	if err != nil {
+		t.Fatalf("read written backup info: %v", err)
+	}
+	if read.Name != bi.Name || read.Status != bi.Status {
+		t.Errorf("read backup info %+v", read)
+	}
+
+	// missing storage mount fails at once, not retried forever
+	c.BackupStorage.BackupDir = path.Join(dir, "not_mounted")
+	start := time.Now()
+	if err := BackupInfoWrite(context.Background(), &bi); err == nil {
+		t.Error("backup info written to missing backup dir")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("write to missing backup dir took %s", time.Since(start))
+	}
 }
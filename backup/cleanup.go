@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"bufio"
+	"cliback/config"
+	"cliback/database"
+	"cliback/status"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// shadows of ShadowName, names of older versions started by generated job name
+	cliShadowRe  = regexp.MustCompile("^(" + shadowPrefix + "|\\d{8}_\\d{6}[FDIP]_)")
+	journalRe    = regexp.MustCompile("^restore_(\\d{8}_\\d{6}[FDIP])\\.list$")
+	journalMux   sync.Mutex
+	journalParts map[string]bool
+)
+
+// defaultStateDir is owned by cliback, not inside clickhouse data dir
+const defaultStateDir = "/var/lib/cliback"
+
+// StateDir returns dir for cliback state files (restore journals)
+func StateDir() string {
+	c := config.New()
+	if len(c.StateDir) > 0 {
+		return c.StateDir
+	}
+	return defaultStateDir
+}
+
+func journalPath(jobName string) string {
+	return path.Join(StateDir(), "restore_"+jobName+".list")
+}
+
+// journalAdd record detached part dir written by restore, used by cleanup after crash
+func journalAdd(partPath string) {
+	c := config.New()
+	journalMux.Lock()
+	defer journalMux.Unlock()
+	if journalParts == nil {
+		journalParts = map[string]bool{}
+	}
+	if journalParts[partPath] {
+		return
+	}
+	journalParts[partPath] = true
+	err := os.MkdirAll(StateDir(), 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(journalPath(c.TaskArgs.JobName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintln(f, partPath)
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Restore journal write error: %v", err)
+	}
+}
+
+// journalRemove drops restore journal after successful restore
+func journalRemove() {
+	c := config.New()
+	journalMux.Lock()
+	defer journalMux.Unlock()
+	err := os.Remove(journalPath(c.TaskArgs.JobName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Restore journal remove error: %v", err)
+	}
+	journalParts = nil
+}
+
+// cleanupError log failed remove and set cleanup fail status
+func cleanupError(p string, err error) {
+	log.Printf("Cleanup: remove %s error: %v", p, err)
+	status.New().SetStatus(status.FailCleanup)
+}
+
+func cleanupMinAge() time.Duration {
+	c := config.New()
+	if c.CleanupMinAge < 1 {
+		return 24 * time.Hour
+	}
+	return time.Duration(c.CleanupMinAge) * time.Hour
+}
+
+func isStale(p string) bool {
+	st, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	return time.Since(st.ModTime()) > cleanupMinAge()
+}
+
+// cleanupShadows remove shadow dirs frozen by cliback, tagged by job name
+// isJobShadow shadow of running job
+func isJobShadow(name string) bool {
+	c := config.New()
+	return len(c.TaskArgs.JobName) > 0 && strings.HasPrefix(name, shadowPrefix+c.TaskArgs.JobName+"_")
+}
+
+func cleanupShadows(ctx context.Context, dryRun bool) []string {
+	c := config.New()
+	ch := database.New()
+	var result []string
+	var names []string
+	for storage, storagePath := range c.ClickhouseStorage {
+		shadow := path.Join(storagePath, "shadow")
+		dirs, err := GetDirs(shadow)
+		if err != nil {
+			continue
+		}
+		for _, d := range dirs {
+			if !cliShadowRe.MatchString(d) || isJobShadow(d) || !isStale(path.Join(shadow, d)) {
+				continue
+			}
+			result = append(result, fmt.Sprintf("shadow %s: %s", storage, path.Join(shadow, d)))
+			if !Contains(names, d) {
+				names = append(names, d)
+			}
+		}
+	}
+	if dryRun {
+		return result
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := ch.UnfreezeByName(name); err != nil && c.TaskArgs.Debug {
+			log.Printf("Unfreeze %s error: %v", name, err)
+		}
+		for storage := range c.ClickhouseStorage {
+			shDir := path.Join(c.ClickhouseStorage[storage], "shadow", name)
+			if _, err := os.Stat(shDir); err == nil {
+				if err := os.RemoveAll(shDir); err != nil {
+					cleanupError(shDir, err)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// cleanupDetached remove parts left in detached by failed restores
+func cleanupDetached(ctx context.Context, dryRun bool) []string {
+	c := config.New()
+	var result []string
+	files, err := ioutil.ReadDir(StateDir())
+	if err != nil {
+		return result
+	}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		m := journalRe.FindStringSubmatch(f.Name())
+		if m == nil || m[1] == c.TaskArgs.JobName {
+			continue
+		}
+		jPath := path.Join(StateDir(), f.Name())
+		if !isStale(jPath) {
+			continue
+		}
+		jf, err := os.Open(jPath)
+		if err != nil {
+			cleanupError(jPath, err)
+			continue
+		}
+		sc := bufio.NewScanner(jf)
+		for sc.Scan() && ctx.Err() == nil {
+			partPath := strings.TrimSpace(sc.Text())
+			// Only part dirs in detached, never touch other paths
+			if len(partPath) < 1 || path.Base(path.Dir(partPath)) != "detached" {
+				continue
+			}
+			if _, err := os.Stat(partPath); err != nil {
+				continue
+			}
+			result = append(result, fmt.Sprintf("detached %s: %s", m[1], partPath))
+			if !dryRun {
+				if err := os.RemoveAll(partPath); err != nil {
+					cleanupError(partPath, err)
+				}
+			}
+		}
+		jf.Close()
+		if !dryRun && ctx.Err() == nil {
+			if err := os.Remove(jPath); err != nil {
+				cleanupError(jPath, err)
+			}
+		}
+	}
+	return result
+}
+
+// Cleanup remove crash leftovers: cliback shadow dirs and restore parts in detached,
+// on ctx cancel stopped before next leftover
+func Cleanup(ctx context.Context, dryRun bool) error {
+	c := config.New()
+	ch := database.New()
+	ch.SetDSN(c.ClickhouseBackupConn)
+	ch.SetContext(ctx)
+	defer ch.Close()
+	err := CheckStorage()
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailClickhouseStorage)
+		return err
+	}
+	runCleanup(ctx, dryRun)
+	return ctx.Err()
+}
+
+func runCleanup(ctx context.Context, dryRun bool) {
+	prefix := "Cleanup:"
+	if dryRun {
+		prefix = "Cleanup (dry run):"
+	}
+	removed := append(cleanupShadows(ctx, dryRun), cleanupDetached(ctx, dryRun)...)
+	for _, r := range removed {
+		log.Printf("%s %s", prefix, r)
+	}
+	log.Printf("%s %d leftovers older then %s", prefix, len(removed), cleanupMinAge())
+}
+
+// startupCleanup runs before backup/restore
+func startupCleanup(ctx context.Context) {
+	c := config.New()
+	if c.SkipStartupCleanup {
+		return
+	}
+	runCleanup(ctx, false)
+}
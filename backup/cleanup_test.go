@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/status"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCleanupShadowNames(t *testing.T) {
+	c := config.New()
+	defer func(jobName string) { c.TaskArgs.JobName = jobName }(c.TaskArgs.JobName)
+	c.TaskArgs.JobName = "nightly"
+
+	for _, name := range []string{
+		ShadowName("nightly", "db", "t"),
+		ShadowName("manual-run", "db", "t"),
+		"20210101_000000F_db_t",
+	} {
+		if !cliShadowRe.MatchString(name) {
+			t.Errorf("shadow %s not matched by cleanup", name)
+		}
+	}
+	for _, name := range []string{"1", "backup_db_t", "user_freeze"} {
+		if cliShadowRe.MatchString(name) {
+			t.Errorf("not cliback shadow %s matched by cleanup", name)
+		}
+	}
+	if !isJobShadow(ShadowName("nightly", "db", "t")) || isJobShadow(ShadowName("nightly2", "db", "t")) {
+		t.Error("shadow of running job not detected")
+	}
+}
+
+func TestCleanupStateDir(t *testing.T) {
+	c := config.New()
+	defer func(dir string) { c.StateDir = dir }(c.StateDir)
+	c.StateDir = ""
+	if StateDir() != defaultStateDir {
+		t.Errorf("state dir %s, expect %s", StateDir(), defaultStateDir)
+	}
+}
+
+func TestCleanupErrorStatus(t *testing.T) {
+	cleanupError("/tmp/leftover", errors.New("permission denied"))
+	if status.New().GetFinalStatus()&status.FailCleanup == 0 {
+		t.Error("cleanup error not set in status")
+	}
+}
+
+func TestCleanupDetachedCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.New()
+	defer func(stateDir, jobName string) { c.StateDir, c.TaskArgs.JobName = stateDir, jobName }(c.StateDir, c.TaskArgs.JobName)
+	c.StateDir = dir
+	c.TaskArgs.JobName = ""
+
+	part := path.Join(dir, "data", "detached", "202105_1_1_0")
+	if err := os.MkdirAll(part, 0755); err != nil {
+		t.Fatal(err)
+	}
+	journal := path.Join(dir, "restore_20210101_000000F.list")
+	if err := ioutil.WriteFile(journal, []byte(part+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(journal, old, old); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cleanupDetached(ctx, false)
+	if _, err := os.Stat(part); err != nil {
+		t.Errorf("part removed after cancel: %v", err)
+	}
+	cleanupDetached(context.Background(), false)
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("stale part not removed: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"fmt"
+	"log"
+)
+
+// ShardDir returns backup sub dir for shard number
+func ShardDir(shardNum uint32) string {
+	return fmt.Sprintf("shard_%d", shardNum)
+}
+
+// setupCluster search local shard in cluster and set shard sub dir for job.
+// Only first alive replica of shard selected for job, returns false for others
+func setupCluster(conn config.Connection) (bool, error) {
+	c := config.New()
+	if len(c.TaskArgs.ShardDir) > 0 {
+		// Shard set manually
+		return true, nil
+	}
+	ch := database.New()
+	replicas, err := ch.GetClusterReplicas(c.ClusterName)
+	if err != nil {
+		return false, err
+	}
+	var local *database.ClusterReplica
+	for i := range replicas {
+		if replicas[i].IsLocal {
+			local = &replicas[i]
+			break
+		}
+	}
+	if local == nil {
+		return false, fmt.Errorf("Local host not found in cluster %s", c.ClusterName)
+	}
+	c.TaskArgs.ShardDir = ShardDir(local.ShardNum)
+	log.Printf("Cluster: %s shard: %d replica: %d", c.ClusterName, local.ShardNum, local.ReplicaNum)
+	for _, r := range replicas {
+		if r.ShardNum != local.ShardNum {
+			continue
+		}
+		if r.IsLocal {
+			return true, nil
+		}
+		rConn := conn
+		rConn.HostName = r.HostName
+		rConn.Port = r.Port
+		if err := database.Ping(rConn); err != nil {
+			log.Printf("Cluster: replica %s:%d not alive: %v", r.HostName, r.Port, err)
+			continue
+		}
+		log.Printf("Cluster: replica %s:%d selected for shard %d", r.HostName, r.Port, r.ShardNum)
+		return false, nil
+	}
+	return true, nil
+}
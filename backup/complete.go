@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/report"
+	"cliback/transport"
+	"errors"
+	"log"
+	"time"
+)
+
+// Backup statuses in backup.json, only complete backup usable for restore and as reference
+const (
+	BackupStatusRunning   = "running"
+	BackupStatusComplete  = "complete"
+	BackupStatusFailed    = "failed"
+	BackupStatusCancelled = "cancelled"
+	// BackupStatusIncomplete complete in backup.json, but commit marker not written
+	BackupStatusIncomplete = "incomplete"
+)
+
+// completeMarker written last, after final backup.json
+const completeMarker = "backup.complete"
+
+var errBackupNotComplete = errors.New("Backup is not complete")
+
+// resultStatus returns backup status by table and file results, failures
+// without table (database level, cleanup, retention) not fail the backup
+func resultStatus(results []report.Result) string {
+	for _, res := range results {
+		if res.Outcome == report.OutcomeFailed && len(res.Table) > 0 {
+			return BackupStatusFailed
+		}
+	}
+	return BackupStatusComplete
+}
+
+// writeCompleteMarker commit backup
+func writeCompleteMarker(bi *backupInfo) error {
+	c := config.New()
+	mf := transport.MetaFile{
+		Name:     completeMarker,
+		Path:     "",
+		JobName:  c.TaskArgs.JobName,
+		TryRetry: false,
+	}
+	mf.Content.WriteString(bi.Name + " " + bi.StopDate + "\n")
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return err
+	}
+	return tr.WriteMeta(&mf)
+}
+
+func hasCompleteMarker(backupName string) bool {
+	mf := transport.MetaFile{
+		Name:     completeMarker,
+		Path:     "",
+		JobName:  backupName,
+		TryRetry: false,
+	}
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return false
+	}
+	return tr.ReadMeta(&mf) == nil
+}
+
+// completeState backups without status made by old versions, they are complete
+func completeState(status string, marker bool) string {
+	switch status {
+	case "":
+		return BackupStatusComplete
+	case BackupStatusComplete:
+		if marker {
+			return BackupStatusComplete
+		}
+		return BackupStatusIncomplete
+	}
+	return status
+}
+
+// BackupState returns status of backup with commit marker check
+func BackupState(bi *backupInfo) string {
+	return completeState(bi.Status, bi.Status == BackupStatusComplete && hasCompleteMarker(bi.Name))
+}
+
+// BackupReadComplete read backup info, fail on not complete backup
+func BackupReadComplete(backupName string) (*backupInfo, error) {
+	bi, err := BackupRead(backupName)
+	if err != nil {
+		return nil, err
+	}
+	if state := BackupState(bi); state != BackupStatusComplete {
+		log.Printf("Backup %s is %s, skip it", backupName, state)
+		return bi, errBackupNotComplete
+	}
+	return bi, nil
+}
+
+// maybeRunning running backup updated recently, may be in progress now
+func maybeRunning(bi *backupInfo) bool {
+	if bi.Status != BackupStatusRunning {
+		return false
+	}
+	t, err := time.ParseInLocation("20060102_150405", bi.StopDate, time.Local)
+	if err != nil {
+		t, err = time.ParseInLocation("20060102_150405", bi.StartDate, time.Local)
+		if err != nil {
+			return false
+		}
+	}
+	return time.Since(t) < cleanupMinAge()
+}
@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"cliback/report"
+	"testing"
+)
+
+func TestCompleteState(t *testing.T) {
+	cases := []struct {
+		status string
+		marker bool
+		expect string
+	}{
+		{"", false, BackupStatusComplete},
+		{BackupStatusComplete, true, BackupStatusComplete},
+		{BackupStatusComplete, false, BackupStatusIncomplete},
+		{BackupStatusRunning, false, BackupStatusRunning},
+		{BackupStatusCancelled, false, BackupStatusCancelled},
+		{BackupStatusFailed, false, BackupStatusFailed},
+	}
+	for _, tc := range cases {
+		if r := completeState(tc.status, tc.marker); r != tc.expect {
+			t.Errorf("completeState(%q, %v) = %s, expect %s", tc.status, tc.marker, r, tc.expect)
+		}
+	}
+}
+
+func TestResultStatus(t *testing.T) {
+	retried := []report.Result{{Database: "db", Table: "t", File: "all_1_1_0/data.bin", Outcome: report.OutcomeOK, Retries: 1}}
+	if r := resultStatus(retried); r != BackupStatusComplete {
+		t.Errorf("retried file status %s, expect %s", r, BackupStatusComplete)
+	}
+	dbFailed := append(retried, report.Result{Database: "db", Outcome: report.OutcomeFailed})
+	if r := resultStatus(dbFailed); r != BackupStatusComplete {
+		t.Errorf("failed database status %s, expect %s", r, BackupStatusComplete)
+	}
+	fileFailed := append(dbFailed, report.Result{Database: "db", Table: "t", File: "all_2_2_0/data.bin", Outcome: report.OutcomeFailed})
+	if r := resultStatus(fileFailed); r != BackupStatusFailed {
+		t.Errorf("failed file status %s, expect %s", r, BackupStatusFailed)
+	}
+	failed := append(retried, report.Result{Database: "db", Table: "t", Outcome: report.OutcomeFailed})
+	if r := resultStatus(failed); r != BackupStatusFailed {
+		t.Errorf("failed table status %s, expect %s", r, BackupStatusFailed)
+	}
+}
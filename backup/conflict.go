@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"fmt"
+	"log"
+)
+
+// Restore policies for target tables with data
+const (
+	ConflictFail             = "fail"
+	ConflictSkip             = "skip"
+	ConflictReplaceTable     = "replace-table"
+	ConflictReplacePartition = "replace-partition"
+	ConflictAppend           = "append"
+)
+
+// conflictPolicy on_conflict of restore opts, append by default
+func conflictPolicy() string {
+	c := config.New()
+	if len(c.ClickhouseRestoreOpts.OnConflict) < 1 {
+		return ConflictAppend
+	}
+	return c.ClickhouseRestoreOpts.OnConflict
+}
+
+// checkConflictPolicy validate on_conflict before restore
+func checkConflictPolicy() error {
+	c := config.New()
+	switch policy := conflictPolicy(); policy {
+	case ConflictFail, ConflictSkip, ConflictReplacePartition, ConflictAppend:
+		return nil
+	case ConflictReplaceTable:
+		if c.TaskArgs.DataOnly {
+			return fmt.Errorf("on_conflict %s not allowed for data only restore", policy)
+		}
+		// dropped table loses restored files, replaced only from staging
+		if !stagingEnabled() {
+			return fmt.Errorf("on_conflict %s requires staging_restore", policy)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Bad on_conflict %s, use %s, %s, %s, %s or %s", policy,
+			ConflictFail, ConflictSkip, ConflictReplaceTable, ConflictReplacePartition, ConflictAppend)
+	}
+}
+
+// resolveTableConflict apply fail and skip policies to target table with data before create,
+// returns reason if table must be skipped. replace-table done after staging restore
+func resolveTableConflict(db, table string) (string, error) {
+	policy := conflictPolicy()
+	if policy != ConflictFail && policy != ConflictSkip {
+		return "", nil
+	}
+	ch := database.New()
+	parts, err := ch.GetPartitions(db, table, "")
+	if err != nil {
+		return "", err
+	}
+	if len(parts) < 1 {
+		return "", nil
+	}
+	if policy == ConflictFail {
+		return "", fmt.Errorf("Table `%s`.`%s` has data, on_conflict is %s", db, table, policy)
+	}
+	log.Printf("Table `%s`.`%s` has data, skip restore", db, table)
+	return "Table has data", nil
+}
+
+// replacePartitions drop target partitions of restored parts before attach
+func replacePartitions(db, table string, ti *tableInfo) error {
+	if conflictPolicy() != ConflictReplacePartition {
+		return nil
+	}
+	ch := database.New()
+	dropped := map[string]bool{}
+	for file := range ti.Files {
+		id := partitionID(PartDir(file))
+		if dropped[id] {
+			continue
+		}
+		if err := ch.DropPartitionID(db, table, id); err != nil {
+			return err
+		}
+		dropped[id] = true
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/report"
+	"errors"
+	"testing"
+)
+
+func TestCheckConflictPolicy(t *testing.T) {
+	c := config.New()
+	defer func(opts config.ChMetaOpts, dataOnly bool) {
+		c.ClickhouseRestoreOpts, c.TaskArgs.DataOnly = opts, dataOnly
+	}(c.ClickhouseRestoreOpts, c.TaskArgs.DataOnly)
+
+	c.ClickhouseRestoreOpts.OnConflict = ""
+	if conflictPolicy() != ConflictAppend || checkConflictPolicy() != nil {
+		t.Errorf("append must be default")
+	}
+	c.ClickhouseRestoreOpts.OnConflict = ConflictReplaceTable
+	if checkConflictPolicy() == nil {
+		t.Errorf("replace-table must fail without staging restore")
+	}
+	c.ClickhouseRestoreOpts.StagingRestore = true
+	for _, policy := range []string{ConflictFail, ConflictSkip, ConflictReplaceTable, ConflictReplacePartition} {
+		c.ClickhouseRestoreOpts.OnConflict = policy
+		if err := checkConflictPolicy(); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+	}
+	c.ClickhouseRestoreOpts.OnConflict = "overwrite"
+	if checkConflictPolicy() == nil {
+		t.Errorf("unknown policy must fail")
+	}
+	c.ClickhouseRestoreOpts.OnConflict = ConflictReplaceTable
+	c.TaskArgs.DataOnly = true
+	if checkConflictPolicy() == nil {
+		t.Errorf("replace-table must fail for data only restore")
+	}
+}
+
+func TestAttachRestoredFailedFiles(t *testing.T) {
+	c := config.New()
+	defer func(opts config.ChMetaOpts) { c.ClickhouseRestoreOpts = opts }(c.ClickhouseRestoreOpts)
+	c.ClickhouseRestoreOpts.OnConflict = ConflictReplacePartition
+
+	ti := tableInfo{
+		Dirs:  []string{"202105_1_1_0"},
+		Files: map[string]fileInfo{"202105_1_1_0/data.bin": {Size: 1}},
+	}
+	report.New().Error("conflict_db", "live", "202105_1_1_0/data.bin", errors.New("read error"))
+	// live partitions are dropped only by server queries, failed table must return before them
+	if err := attachRestored("conflict_db", "live", &ti, ""); err != errFailedFiles {
+		t.Errorf("attach with failed files: %v, expect %v", err, errFailedFiles)
+	}
+}
@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"log"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// matchName glob pattern or regexp in slashes /re/ matched with whole name
+func matchName(pattern, name string) bool {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			log.Printf("Bad filter regexp %s: %v", pattern, err)
+			return false
+		}
+		return re.MatchString(name)
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// isPattern glob or regexp, not exact name
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[") || (len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"))
+}
+
+// splitObject split db.table pattern, db regexp /re/ may contain dots, table empty for db pattern
+func splitObject(pattern string) (string, string) {
+	if strings.HasPrefix(pattern, "/") {
+		if end := strings.Index(pattern[1:], "/"); end >= 0 {
+			db := pattern[:end+2]
+			return db, strings.TrimPrefix(pattern[end+2:], ".")
+		}
+	}
+	kv := strings.SplitN(pattern, ".", 2)
+	if len(kv) < 2 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
+
+// excluded db.table matched by exclude pattern, db pattern without table excludes database
+func excluded(excludes []string, db, table string) bool {
+	for _, pattern := range excludes {
+		pdb, ptable := splitObject(pattern)
+		if !matchName(pdb, db) {
+			continue
+		}
+		if len(ptable) < 1 || (len(table) > 0 && matchName(ptable, table)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMatch db (table empty) or db.table selected by filter with patterns, nil filter selects all
+func filterMatch(filter map[string][]string, excludes []string, db, table string) bool {
+	if excluded(excludes, db, table) {
+		return false
+	}
+	if filter == nil {
+		return true
+	}
+	for pdb, tables := range filter {
+		if !matchName(pdb, db) {
+			continue
+		}
+		if len(table) < 1 || len(tables) < 1 {
+			return true
+		}
+		for _, ptable := range tables {
+			if matchName(ptable, table) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseFilter parse comma separated db or db.table patterns into filter
+func ParseFilter(s string) map[string][]string {
+	filter := map[string][]string{}
+	wholeDB := map[string]bool{}
+	for _, item := range ParsePatterns(s) {
+		db, table := splitObject(item)
+		if len(table) < 1 {
+			wholeDB[db] = true
+		}
+		filter[db] = append(filter[db], table)
+	}
+	for db := range wholeDB {
+		filter[db] = nil
+	}
+	return filter
+}
+
+// ParsePatterns split comma separated patterns, commas in /regexp/ kept
+func ParsePatterns(s string) []string {
+	var result []string
+	var cur strings.Builder
+	inRe := false
+	for _, r := range s {
+		switch {
+		case r == '/':
+			inRe = !inRe
+		case r == ',' && !inRe:
+			if item := strings.TrimSpace(cur.String()); len(item) > 0 {
+				result = append(result, item)
+			}
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if item := strings.TrimSpace(cur.String()); len(item) > 0 {
+		result = append(result, item)
+	}
+	return result
+}
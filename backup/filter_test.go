@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	filter := map[string][]string{
+		"events":        {"clicks_*", "/views_\\d+/"},
+		"billing":       nil,
+		"/shop_[a-z]+/": {},
+	}
+	excludes := []string{"*.tmp_*", "staging_*"}
+	cases := []struct {
+		db, table string
+		want      bool
+	}{
+		{"events", "", true},
+		{"events", "clicks_2021", true},
+		{"events", "views_12", true},
+		{"events", "views_x", false},
+		{"billing", "orders", true},
+		{"billing", "tmp_orders", false},
+		{"shop_eu", "items", true},
+		{"shop_1", "items", false},
+		{"other", "", false},
+	}
+	for _, tc := range cases {
+		if got := filterMatch(filter, excludes, tc.db, tc.table); got != tc.want {
+			t.Errorf("%s.%s: got %v want %v", tc.db, tc.table, got, tc.want)
+		}
+	}
+	if filterMatch(nil, excludes, "staging_1", "") || filterMatch(nil, excludes, "staging_1", "t") {
+		t.Errorf("excluded database selected")
+	}
+	if !filterMatch(nil, excludes, "db", "t") {
+		t.Errorf("nil filter must select all")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	got := ParseFilter("db1, db2.t_*, db2.x, db1.t, /re_\\d{1,2}/.t")
+	want := map[string][]string{
+		"db1":           nil,
+		"db2":           {"t_*", "x"},
+		"/re_\\d{1,2}/": {"t"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
@@ -3,12 +3,17 @@ package backup
 import (
 	"cliback/config"
 	"cliback/database"
+	"cliback/report"
 	"cliback/transport"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -49,7 +54,9 @@ func (ti *tableInfo) AddJob(j *transport.CliFile) {
 		BSize:     j.BSize,
 		Sha1:      j.Sha1,
 		Reference: j.Reference,
+		RefPath:   j.RefPath,
 		Storage:   storage,
+		MTime:     j.MTime,
 	}
 	ti.Size += j.Size
 	ti.BSize += j.BSize
@@ -93,19 +100,33 @@ type fileInfo struct {
 	BSize     int64  `json:"bsize"`
 	Sha1      string `json:"sha1"`
 	Reference string `json:"reference,omitempty"`
+	RefPath   string `json:"ref_path,omitempty"`
 	Storage   string `json:"storage,omitempty"`
+	MTime     int64  `json:"mtime,omitempty"`
 }
+
+// partInfo part from system.parts, reference is backup with part files for reused part
+type partInfo struct {
+	Hash             string `json:"hash"`
+	ModificationTime string `json:"modification_time"`
+	Reference        string `json:"reference,omitempty"`
+}
+
 type tableInfo struct {
 	counter
 	DbDir        string              `json:"db_dir"`
 	TableDir     string              `json:"table_dir"`
 	BackupStatus string              `json:"backup_status"`
+	Error        string              `json:"error,omitempty"`
 	Partitions   []string            `json:"partitions"`
+	Selector     string              `json:"selector,omitempty"`
 	Dirs         []string            `json:"dirs"`
 	Files        map[string]fileInfo `json:"files"`
 	MetaData     fileInfo            `json:"metadata"` // Will be Used in v2
 	Reference    []string            `json:"reference,omitempty"`
 	Storages     []string            `json:"storages,omitempty"`
+	Policy       string              `json:"storage_policy,omitempty"`
+	Parts        map[string]partInfo `json:"parts,omitempty"`
 }
 type databaseInfo struct {
 	counter
@@ -118,11 +139,16 @@ type backupInfo struct {
 	Name         string                  `json:"name"`
 	Type         string                  `json:"type"`
 	Version      uint                    `json:"version"`
+	Cluster      string                  `json:"cluster,omitempty"`
+	Shard        string                  `json:"shard,omitempty"`
+	Server       *serverInfo             `json:"server,omitempty"`
+	Status       string                  `json:"status,omitempty"`
 	StartDate    string                  `json:"start_date"`
 	StopDate     string                  `json:"stop_date"`
 	Reference    []string                `json:"reference,omitempty"`
 	DBS          map[string]databaseInfo `json:"dbs"`
 	BackupFilter map[string][]string     `json:"filter"`
+	Results      []report.Result         `json:"results,omitempty"`
 }
 
 // Contains tells whether a contains x.
@@ -147,7 +173,10 @@ func Position(a []string, x string) (int, error) {
 
 // GetFormatedTime return current time in formated style
 func GetFormatedTime() string {
-	t := time.Now()
+	return formatTime(time.Now())
+}
+
+func formatTime(t time.Time) string {
 	formatted := fmt.Sprintf("%04d%02d%02d_%02d%02d%02d",
 		t.Year(), t.Month(), t.Day(),
 		t.Hour(), t.Minute(), t.Second())
@@ -159,6 +188,20 @@ func GenerateBackupName() string {
 	return GetFormatedTime() + strings.ToUpper(c.TaskArgs.BackupType[:1])
 }
 
+// checkClusterJobName checks job name given to all hosts of cluster backup,
+// host clocks differ so name must be the same -j on every host
+func checkClusterJobName(name string) error {
+	c := config.New()
+	if len(name) < 1 {
+		return errors.New("Cluster backup requires job name (-j) same on all hosts")
+	}
+	want := strings.ToUpper(c.TaskArgs.BackupType[:1])
+	if ok, _ := regexp.MatchString("^\\d{8}_\\d{6}"+want+"$", name); !ok {
+		return fmt.Errorf("Cluster backup job name %s must be YYYYMMDD_HHMMSS%s", name, want)
+	}
+	return nil
+}
+
 func GetDirs(p string) ([]string, error) {
 	var result []string
 	files, err := ioutil.ReadDir(p)
@@ -173,11 +216,11 @@ func GetDirs(p string) ([]string, error) {
 	return result, nil
 }
 
-func GetDirsInShadow(tInfo database.TableInfo) []string {
+func GetDirsInShadow(tInfo database.TableInfo, shadowName string) []string {
 	var result []string
 	c := config.New()
 	for storage := range c.ClickhouseStorage {
-		res, err := GetDirs(path.Join(c.GetShadow(storage), tInfo.GetShortPath()))
+		res, err := GetDirs(path.Join(c.GetShadow(storage, shadowName), tInfo.GetShortPath()))
 		if err != nil {
 			continue
 		}
@@ -188,10 +231,25 @@ func GetDirsInShadow(tInfo database.TableInfo) []string {
 
 func CheckStorage() error {
 	c := config.New()
+	ch := database.New()
+	diskTypes, err := ch.GetDiskTypes()
+	if err != nil {
+		// system.disks without type column on old servers, all disks are local
+		log.Printf("Get disk types error: %v", err)
+	} else {
+		c.ClickhouseDiskTypes = diskTypes
+	}
+	for disk := range c.ClickhouseDiskTypes {
+		if !c.IsObjectDisk(disk) {
+			continue
+		}
+		if _, ok := c.ObjectDisks[disk]; !ok {
+			log.Printf("Disk %s is %s, object_disks connection not set, tables on it can't be processed", disk, c.ClickhouseDiskTypes[disk])
+		}
+	}
 	if c.ClickhouseStorage != nil {
 		return nil
 	}
-	ch := database.New()
 	chStore, err := ch.GetDisks()
 	if err != nil {
 		return err
@@ -219,10 +277,31 @@ func SplitShadow(p string) ([]string, error) {
 	return []string{resultShadow, resultPath, resultFile}, nil
 }
 
-func RemoveShadowDirs() {
+// shadowPrefix marks shadows frozen by cliback, found by cleanup for any job name
+const shadowPrefix = "cliback_"
+
+// ShadowName returns freeze name for table, tagged by job name. Hash of db and table
+// always added, sanitized names like db_a.b and db.a_b are the same
+func ShadowName(jobName, db, table string) string {
+	re := regexp.MustCompile("[^A-Za-z0-9_]")
+	sdb, stable := re.ReplaceAllString(db, "_"), re.ReplaceAllString(table, "_")
+	return fmt.Sprintf(shadowPrefix+"%s_%s_%s_%08x", jobName, sdb, stable, crc32.ChecksumIEEE([]byte(db+"\x00"+table)))
+}
+
+// RemoveShadowDirs unfreeze and remove shadow dirs of freeze
+func RemoveShadowDirs(shadowName string) {
 	c := config.New()
+	if len(shadowName) < 1 {
+		return
+	}
+	if _, err := strconv.Atoi(shadowName); err != nil {
+		ch := database.New()
+		if err := ch.UnfreezeByName(shadowName); err != nil && c.TaskArgs.Debug {
+			log.Printf("Unfreeze %s error: %v", shadowName, err)
+		}
+	}
 	for storage := range c.ClickhouseStorage {
-		shDir := c.GetShadow(storage)
+		shDir := c.GetShadow(storage, shadowName)
 		st, err := os.Stat(shDir)
 		if err != nil {
 			continue
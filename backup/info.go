@@ -9,6 +9,13 @@ import (
 func (bi *backupInfo) String() string {
 	var outStr string
 	outStr += fmt.Sprintf("%s backup: %s\n", bi.Type, bi.Name)
+	if len(bi.Cluster) > 0 {
+		outStr += fmt.Sprintf("\tcluster: %s %s\n", bi.Cluster, bi.Shard)
+	}
+	if bi.Server != nil {
+		outStr += fmt.Sprintf("\tserver: %s version: %s timezone: %s\n", bi.Server.HostName, bi.Server.Version, bi.Server.Timezone)
+	}
+	outStr += fmt.Sprintf("\tstatus: %s\n", BackupState(bi))
 	outStr += fmt.Sprintf("\ttimestamp start/stop: %s / %s\n", bi.StartDate, bi.StopDate)
 	outStr += fmt.Sprintf("\tdb size: %s backup size: %s\n", ByteCountIEC(bi.Size), ByteCountIEC(bi.BSize))
 	outStr += fmt.Sprintf("\trepo size: %s repo backup size: %s\n", ByteCountIEC(bi.RepoSize), ByteCountIEC(bi.RepoBSize))
@@ -19,10 +26,17 @@ func (bi *backupInfo) String() string {
 	if bi.Type == "part" {
 		for db, dbInfo := range bi.DBS {
 			for table, tableInfo := range dbInfo.Tables {
+				if len(tableInfo.Selector) > 0 {
+					outStr += fmt.Sprintf("\tdb: %s table: %s selector: %s parts: %v\n", db, table, tableInfo.Selector, tableInfo.Partitions)
+					continue
+				}
 				outStr += fmt.Sprintf("\tdb: %s table: %s parts: %v\n", db, table, tableInfo.Partitions)
 			}
 		}
 	}
+	for _, res := range bi.Results {
+		outStr += fmt.Sprintf("\t%s\n", res)
+	}
 	return outStr
 }
 
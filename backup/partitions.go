@@ -0,0 +1,322 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partitionTerm one term of partition selector: value, tuple value, LIKE pattern, range from..to,
+// since:<date> or part:<glob> of part names (restore only)
+type partitionTerm struct {
+	value    string
+	like     *regexp.Regexp
+	from, to string
+	since    time.Time
+	part     string
+}
+
+// partitionSelector comma separated terms, partition selected if any term matched
+type partitionSelector []partitionTerm
+
+// expandPartitionMacros replace {yyyy}, {yyyymm}, {yyyymmdd} by date of now
+func expandPartitionMacros(s string, now time.Time) string {
+	return strings.NewReplacer(
+		"{yyyymmdd}", now.Format("20060102"),
+		"{yyyymm}", now.Format("200601"),
+		"{yyyy}", now.Format("2006"),
+	).Replace(s)
+}
+
+// parseSince date (2006-01-02, 2006-01-02 15:04:05) or duration back from now (24h)
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad partition selector since: %s", s)
+}
+
+// isLikePattern term with not escaped %, _ alone is a part of partition values like 2021_01
+func isLikePattern(term string) bool {
+	for i := 0; i < len(term); i++ {
+		switch term[i] {
+		case '\\':
+			i++
+		case '%':
+			return true
+		}
+	}
+	return false
+}
+
+// likeToRegexp converts SQL LIKE pattern (% and _, escaped by \) to regexp
+func likeToRegexp(pattern string) *regexp.Regexp {
+	var re strings.Builder
+	re.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			re.WriteString(".*")
+		case r == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String())
+}
+
+// splitSelector split selector by commas out of parentheses and quotes,
+// tuple partition values like (202101,'eu') kept as one term
+func splitSelector(s string) []string {
+	var terms []string
+	var depth int
+	var quote bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quote {
+				i++
+			}
+		case '\'':
+			quote = !quote
+		case '(':
+			if !quote {
+				depth++
+			}
+		case ')':
+			if !quote && depth > 0 {
+				depth--
+			}
+		case ',':
+			if !quote && depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func parsePartitionSelector(s string, now time.Time) (partitionSelector, error) {
+	var ps partitionSelector
+	for _, term := range splitSelector(expandPartitionMacros(s, now)) {
+		term = strings.TrimSpace(term)
+		if len(term) < 1 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(term, "since:"):
+			since, err := parseSince(strings.TrimSpace(strings.TrimPrefix(term, "since:")), now)
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, partitionTerm{since: since})
+		case strings.HasPrefix(term, "part:"):
+			ps = append(ps, partitionTerm{part: strings.TrimPrefix(term, "part:")})
+		case strings.HasPrefix(term, "("):
+			// tuple partition matched by value as in system.parts
+			ps = append(ps, partitionTerm{value: term})
+		case strings.Contains(term, ".."):
+			bounds := strings.SplitN(term, "..", 2)
+			ps = append(ps, partitionTerm{from: bounds[0], to: bounds[1]})
+		case isLikePattern(term):
+			ps = append(ps, partitionTerm{like: likeToRegexp(term)})
+		default:
+			ps = append(ps, partitionTerm{value: term})
+		}
+	}
+	if len(ps) < 1 {
+		return nil, errors.New("Empty partition selector")
+	}
+	return ps, nil
+}
+
+// comparePartition compare numeric partitions as numbers, others as strings
+func comparePartition(a, b string) int {
+	na, errA := strconv.ParseInt(a, 10, 64)
+	nb, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func (t partitionTerm) match(value string) bool {
+	switch {
+	case t.like != nil:
+		return t.like.MatchString(value)
+	case len(t.from) > 0 || len(t.to) > 0:
+		if len(t.from) > 0 && comparePartition(value, t.from) < 0 {
+			return false
+		}
+		if len(t.to) > 0 && comparePartition(value, t.to) > 0 {
+			return false
+		}
+		return true
+	}
+	return value == t.value
+}
+
+// Match partition by value or partition_id
+func (ps partitionSelector) Match(p database.PartitionInfo) bool {
+	for _, t := range ps {
+		if len(t.part) > 0 {
+			continue
+		}
+		if !t.since.IsZero() {
+			if !p.ModificationTime.Before(t.since) {
+				return true
+			}
+			continue
+		}
+		if t.match(p.Partition) || t.match(p.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPart part dir by part name or its partition_id, since terms not matched
+// and rejected by selectRestoreParts
+func (ps partitionSelector) MatchPart(dir string) bool {
+	id := partitionID(dir)
+	for _, t := range ps {
+		if len(t.part) > 0 {
+			if ok, _ := path.Match(t.part, dir); ok {
+				return true
+			}
+			continue
+		}
+		if t.since.IsZero() && t.match(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionID of part dir <partition_id>_<min block>_<max block>_<level>
+func partitionID(dir string) string {
+	return strings.SplitN(dir, "_", 2)[0]
+}
+
+var (
+	errRestoreSince = errors.New("Partition selector since: not supported for restore")
+	errRestoreTuple = errors.New("Partition selector tuple value not supported for restore, use partition_id")
+)
+
+// selectRestoreParts keep files and dirs of parts matched by selector, since and tuple terms
+// rejected as backup has no modification time and partition values of parts
+func selectRestoreParts(ti *tableInfo, selector string) error {
+	ps, err := parsePartitionSelector(selector, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, t := range ps {
+		if !t.since.IsZero() {
+			return errRestoreSince
+		}
+		if strings.HasPrefix(t.value, "(") {
+			return errRestoreTuple
+		}
+	}
+	files := map[string]fileInfo{}
+	dirs := map[string]bool{}
+	for name, fi := range ti.Files {
+		dir := PartDir(name)
+		if !ps.MatchPart(dir) {
+			continue
+		}
+		files[name] = fi
+		dirs[dir] = true
+	}
+	ti.Files = files
+	ti.Dirs = ti.Dirs[:0:0]
+	for dir := range dirs {
+		ti.Dirs = append(ti.Dirs, dir)
+	}
+	sort.Strings(ti.Dirs)
+	return nil
+}
+
+// tablePartitionSelector -p of part backup for all tables, else first matched partition_filter rule
+func tablePartitionSelector(db, table string) string {
+	c := config.New()
+	if c.TaskArgs.BackupType != "part" {
+		return ""
+	}
+	if len(c.TaskArgs.JobPartition) > 0 {
+		return c.TaskArgs.JobPartition
+	}
+	return matchPartitionRule(c.PartitionFilter, db, table)
+}
+
+// restorePartitionSelector selector of first matched restore_partitions rule
+func restorePartitionSelector(db, table string) string {
+	c := config.New()
+	return matchPartitionRule(c.RestorePartitions, db, table)
+}
+
+func matchPartitionRule(rules []config.PartitionRule, db, table string) string {
+	for _, rule := range rules {
+		if len(rule.Database) > 0 {
+			if ok, _ := path.Match(rule.Database, db); !ok {
+				continue
+			}
+		}
+		if len(rule.Table) > 0 {
+			if ok, _ := path.Match(rule.Table, table); !ok {
+				continue
+			}
+		}
+		return rule.Partitions
+	}
+	return ""
+}
+
+// selectPartitions returns partitions and their ids matched by selector
+func selectPartitions(db, table, selector string) ([]string, []string, error) {
+	ps, err := parsePartitionSelector(selector, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := database.New()
+	infos, err := ch.GetPartitionInfos(db, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	var parts, ids []string
+	for _, p := range infos {
+		if ps.Match(p) {
+			parts = append(parts, p.Partition)
+			ids = append(ids, p.ID)
+		}
+	}
+	return parts, ids, nil
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"cliback/report"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPartitionSelector(t *testing.T) {
+	now := time.Date(2021, 6, 15, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		selector string
+		part     database.PartitionInfo
+		want     bool
+	}{
+		{"202101,202102", database.PartitionInfo{Partition: "202102", ID: "202102"}, true},
+		{"202101,202102", database.PartitionInfo{Partition: "202103", ID: "202103"}, false},
+		{"2021%", database.PartitionInfo{Partition: "202103", ID: "202103"}, true},
+		{"2021_2", database.PartitionInfo{Partition: "202101", ID: "202101"}, false},
+		{"2021_01", database.PartitionInfo{Partition: "2021_01", ID: "2021_01"}, true},
+		{"2021_01", database.PartitionInfo{Partition: "2021-01", ID: "2021-01"}, false},
+		{"2021_%", database.PartitionInfo{Partition: "2021-01", ID: "2021-01"}, true},
+		{"2021\\_%", database.PartitionInfo{Partition: "2021-01", ID: "2021-01"}, false},
+		{"2021\\_%", database.PartitionInfo{Partition: "2021_01", ID: "2021_01"}, true},
+		{"100\\%", database.PartitionInfo{Partition: "1001", ID: "1001"}, false},
+		{"202101..202106", database.PartitionInfo{Partition: "202106", ID: "202106"}, true},
+		{"202101..202106", database.PartitionInfo{Partition: "202107", ID: "202107"}, false},
+		{"9..10", database.PartitionInfo{Partition: "10", ID: "10"}, true},
+		{"{yyyymm}", database.PartitionInfo{Partition: "202106", ID: "202106"}, true},
+		{"since:2021-06-01", database.PartitionInfo{Partition: "202105", ModificationTime: now.Add(-time.Hour)}, true},
+		{"since:48h", database.PartitionInfo{Partition: "202105", ModificationTime: now.Add(-72 * time.Hour)}, false},
+		{"abc", database.PartitionInfo{Partition: "('abc',1)", ID: "abc"}, true},
+		{"(202101,'eu'),(202102,'us')", database.PartitionInfo{Partition: "(202102,'us')", ID: "f0e1"}, true},
+		{"(202101,'eu'),202102", database.PartitionInfo{Partition: "(202101,'us')", ID: "f0e2"}, false},
+		{"(202101,'eu_west')", database.PartitionInfo{Partition: "(202101,'eu_west')", ID: "f0e3"}, true},
+		{"(1,'a,b'),7", database.PartitionInfo{Partition: "7", ID: "7"}, true},
+	}
+	for _, tc := range cases {
+		ps, err := parsePartitionSelector(tc.selector, now)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.selector, err)
+		}
+		if got := ps.Match(tc.part); got != tc.want {
+			t.Errorf("%s match %+v: got %v want %v", tc.selector, tc.part, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", " , ", "since:yesterday"} {
+		if _, err := parsePartitionSelector(bad, now); err == nil {
+			t.Errorf("selector %q must fail", bad)
+		}
+	}
+}
+
+func TestSelectRestoreParts(t *testing.T) {
+	ti := tableInfo{
+		Dirs: []string{"202104_1_1_0", "202105_2_2_0", "202106_3_3_0", "202107_4_4_0"},
+		Files: map[string]fileInfo{
+			"202104_1_1_0/data.bin": {Size: 1},
+			"202105_2_2_0/data.bin": {Size: 2},
+			"202105_2_2_0/data.mrk": {Size: 3},
+			"202106_3_3_0/data.bin": {Size: 4},
+			"202107_4_4_0/data.bin": {Size: 5},
+		},
+	}
+	err := selectRestoreParts(&ti, "202105,part:202107_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ti.Files) != 3 {
+		t.Errorf("bad files: %v", ti.Files)
+	}
+	if len(ti.Dirs) != 2 || ti.Dirs[0] != "202105_2_2_0" || ti.Dirs[1] != "202107_4_4_0" {
+		t.Errorf("bad dirs: %v", ti.Dirs)
+	}
+	if err := selectRestoreParts(&ti, "since:yesterday"); err == nil {
+		t.Errorf("bad selector must fail")
+	}
+	if err := selectRestoreParts(&ti, "202105,since:24h"); err != errRestoreSince {
+		t.Errorf("since selector on restore: %v, expect %v", err, errRestoreSince)
+	}
+	if err := selectRestoreParts(&ti, "(202105,'eu')"); err != errRestoreTuple {
+		t.Errorf("tuple selector on restore: %v, expect %v", err, errRestoreTuple)
+	}
+	if err := selectRestoreParts(&ti, "202001"); err != nil || len(ti.Dirs) != 0 {
+		t.Errorf("not matched selector: %v, dirs %v", err, ti.Dirs)
+	}
+}
+
+func TestRestoreSelectorErrorTargetName(t *testing.T) {
+	c := config.New()
+	defer func(rules []config.PartitionRule) { c.RestorePartitions = rules }(c.RestorePartitions)
+	c.RestorePartitions = []config.PartitionRule{{Database: "sel_src", Partitions: "since:24h"}}
+	ch := database.New()
+	ch.SetMetaOpts(config.ChMetaOpts{DDLRewrite: []config.DDLRewriteRule{{Database: "sel_src", NewDatabase: "sel_dst"}}})
+	defer ch.SetMetaOpts(c.ClickhouseRestoreOpts)
+
+	bi := &backupInfo{DBS: map[string]databaseInfo{
+		"sel_src": {Tables: map[string]tableInfo{"t": {}}},
+	}}
+	if err := restoreOneTable(context.Background(), nil, bi, "sel_src", "t"); err != errRestoreSince {
+		t.Fatalf("restore error %v, expect %v", err, errRestoreSince)
+	}
+	if failed := report.New().Failed("sel_dst", "t"); len(failed) != 1 {
+		t.Errorf("target table results %v, expect selector failure", failed)
+	}
+	if failed := report.New().Failed("sel_src", "t"); len(failed) > 0 {
+		t.Errorf("source table results %v, expect none", failed)
+	}
+}
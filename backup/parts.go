@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"log"
+)
+
+// partStrategy part level increment: unchanged parts by system.parts referenced without reading files
+func partStrategy() bool {
+	c := config.New()
+	if c.IncrementalStrategy != "part" {
+		return false
+	}
+	return c.TaskArgs.BackupType == "diff" || c.TaskArgs.BackupType == "incr"
+}
+
+// tableParts active parts of table, nil on error (file level increment used)
+func tableParts(db, table string) map[string]partInfo {
+	ch := database.New()
+	parts, err := ch.GetParts(db, table)
+	if err != nil {
+		log.Printf("Get parts `%s`.`%s` error: %v, use file increment", db, table, err)
+		return nil
+	}
+	result := map[string]partInfo{}
+	for _, p := range parts {
+		result[p.Name] = partInfo{Hash: p.Hash, ModificationTime: p.ModificationTime}
+	}
+	return result
+}
+
+// reuseParts add files of frozen parts unchanged since previous backups,
+// returns part dirs that not need backup
+func reuseParts(ti *tableInfo, db, table string) map[string]bool {
+	skip := map[string]bool{}
+	if len(ti.Parts) < 1 {
+		return skip
+	}
+	pbs := GetPreviousBackups()
+	for _, dir := range ti.Dirs {
+		p, ok := ti.Parts[dir]
+		if !ok || len(p.Hash) < 1 {
+			continue
+		}
+		ref, ok := pbs.LookupPart(db, table, dir, p.Hash, p.ModificationTime)
+		if !ok {
+			continue
+		}
+		for name, fi := range ref.Files {
+			fi := fi
+			ti.Add(&fi, name)
+		}
+		p.Reference = ref.Backup
+		ti.Parts[dir] = p
+		skip[dir] = true
+	}
+	if len(skip) > 0 {
+		log.Printf("Table `%s`.`%s` %d of %d parts unchanged", db, table, len(skip), len(ti.Dirs))
+	}
+	return skip
+}
@@ -0,0 +1,148 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// placement choose restore disks for parts by table storage policy, one ledger for all
+// restored tables, so parts of all tables balanced by free space of disks
+type placement struct {
+	mux      sync.Mutex
+	policies map[string][][]string
+	free     map[string]int64
+	planned  map[string]int64
+	tables   map[string]map[string]string
+}
+
+// restorePlacement ledger of running restore, nil restore parts to backup disks
+var restorePlacement *placement
+
+// newPlacement fetch storage policies and free space of disks once for restore
+func newPlacement() (*placement, error) {
+	ch := database.New()
+	policies, err := ch.GetPoliciesVolumes()
+	if err != nil {
+		return nil, err
+	}
+	free, err := ch.GetDisksFreeSpace()
+	if err != nil {
+		return nil, err
+	}
+	return &placement{
+		policies: policies,
+		free:     free,
+		planned:  map[string]int64{},
+		tables:   map[string]map[string]string{},
+	}, nil
+}
+
+// mostFree returns disk with max free space after planned parts
+func (p *placement) mostFree(disks []string) string {
+	c := config.New()
+	result := ""
+	var resultFree int64
+	for _, d := range disks {
+		if _, ok := c.ClickhouseStorage[d]; !ok {
+			continue
+		}
+		f := p.free[d] - p.planned[d]
+		if len(result) < 1 || f > resultFree {
+			result, resultFree = d, f
+		}
+	}
+	return result
+}
+
+// Place returns target disk of policy for part from source storage
+func (p *placement) Place(policy, storage string, size int64) string {
+	c := config.New()
+	if len(storage) < 1 {
+		storage = "default"
+	}
+	if mapped, ok := c.ClickhouseRestoreOpts.DiskMap[storage]; ok {
+		storage = mapped
+	}
+	volumes := p.policies[policy]
+	disk := ""
+	for _, vol := range volumes {
+		if Contains(vol, storage) {
+			if len(vol) == 1 {
+				disk = storage
+			} else {
+				// JBOD volume, balance by free space
+				disk = p.mostFree(vol)
+			}
+			break
+		}
+	}
+	if len(disk) < 1 && len(volumes) > 0 {
+		disk = p.mostFree(volumes[0])
+	}
+	if len(disk) > 0 {
+		p.planned[disk] += size
+	}
+	return disk
+}
+
+// PartDir returns part dir of backuped file name
+func PartDir(fileName string) string {
+	return strings.SplitN(fileName, "/", 2)[0]
+}
+
+// defaultDirs set backup dirs of table for backups without them
+func (ti *tableInfo) defaultDirs(db, table string) {
+	if len(ti.DbDir) < 1 {
+		ti.DbDir = db
+	}
+	if len(ti.TableDir) < 1 {
+		ti.TableDir = table
+	}
+}
+
+// planPlacement returns part dir -> target disk, nil if table has no storage policy
+// or no placement. Table planned once, space check and restore share the plan
+func (p *placement) planPlacement(ti *tableInfo, tm database.TableInfo) map[string]string {
+	if p == nil || len(tm.StoragePolicy) < 1 {
+		return nil
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	key := ti.DbDir + "/" + ti.TableDir
+	if result, ok := p.tables[key]; ok {
+		return result
+	}
+	type partSize struct {
+		name    string
+		storage string
+		size    int64
+	}
+	parts := map[string]*partSize{}
+	for file, fi := range ti.Files {
+		pd := PartDir(file)
+		if _, ok := parts[pd]; !ok {
+			parts[pd] = &partSize{name: pd, storage: fi.Storage}
+		}
+		parts[pd].size += fi.Size
+	}
+	var ordered []*partSize
+	for _, ps := range parts {
+		ordered = append(ordered, ps)
+	}
+	// Big parts first for better balance
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].size == ordered[j].size {
+			return ordered[i].name < ordered[j].name
+		}
+		return ordered[i].size > ordered[j].size
+	})
+	result := map[string]string{}
+	for _, ps := range ordered {
+		result[ps.name] = p.Place(tm.StoragePolicy, ps.storage, ps.size)
+	}
+	p.tables[key] = result
+	return result
+}
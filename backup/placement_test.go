@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"testing"
+)
+
+func TestPlacementSharedLedger(t *testing.T) {
+	c := config.New()
+	defer func(storage map[string]string) { c.ClickhouseStorage = storage }(c.ClickhouseStorage)
+	c.ClickhouseStorage = map[string]string{"default": "/var/lib/clickhouse", "jbod1": "/mnt/jbod1", "jbod2": "/mnt/jbod2"}
+
+	p := &placement{
+		policies: map[string][][]string{"jbod": {{"jbod1", "jbod2"}}},
+		free:     map[string]int64{"jbod1": 100, "jbod2": 100},
+		planned:  map[string]int64{},
+		tables:   map[string]map[string]string{},
+	}
+	tm := database.TableInfo{StoragePolicy: "jbod"}
+	t1 := tableInfo{DbDir: "db", TableDir: "t1", Files: map[string]fileInfo{"all_1_1_0/data.bin": {Size: 60}}}
+	t2 := tableInfo{DbDir: "db", TableDir: "t2", Files: map[string]fileInfo{"all_1_1_0/data.bin": {Size: 50}}}
+	d1 := p.planPlacement(&t1, tm)["all_1_1_0"]
+	d2 := p.planPlacement(&t2, tm)["all_1_1_0"]
+	if len(d1) < 1 || len(d2) < 1 || d1 == d2 {
+		t.Errorf("parts of two tables placed on %q and %q, expect different disks", d1, d2)
+	}
+	// planned again by restore, same disks, ledger not changed
+	if d := p.planPlacement(&t1, tm)["all_1_1_0"]; d != d1 {
+		t.Errorf("second plan of table on %s, expect %s", d, d1)
+	}
+	if p.planned[d1]+p.planned[d2] != 110 {
+		t.Errorf("planned %v, expect 110 bytes total", p.planned)
+	}
+	var none *placement
+	if disks := none.planPlacement(&t1, tm); disks != nil {
+		t.Errorf("nil placement planned %v", disks)
+	}
+}
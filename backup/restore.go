@@ -3,14 +3,15 @@ package backup
 import (
 	"cliback/config"
 	"cliback/database"
+	"cliback/report"
 	"cliback/status"
 	"cliback/transport"
 	"cliback/workerpool"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
-	"os"
-	"time"
 )
 
 func GetMetaForRestore() (*backupInfo, error) {
@@ -32,14 +33,14 @@ func GetMetaForRestore() (*backupInfo, error) {
 		if !Contains(metas, c.TaskArgs.JobName) {
 			return bi, errors.New("Job #{c.TaskArgs.JobName} not exists for restore")
 		}
-		return BackupRead(backupName)
+		return BackupReadComplete(backupName)
 	} else {
 		log.Printf("Start Restore job: `Last`")
 		for i := len(metas) - 1; i >= 0; i-- {
 			backupName = metas[i]
 			c.TaskArgs.JobName = backupName
 			log.Printf("Try read meta for backup: %s", backupName)
-			bi, err = BackupRead(backupName)
+			bi, err = BackupReadComplete(backupName)
 			if err != nil {
 				log.Printf("Read meta for backup: %s, Fail %s", backupName, err)
 				continue
@@ -50,8 +51,22 @@ func GetMetaForRestore() (*backupInfo, error) {
 	return bi, errors.New("No backups for restore")
 }
 
-func Restore() error {
+// Restore restore backup, on ctx cancel stop new files and not attach partial tables
+func Restore(ctx context.Context) error {
 	c := config.New()
+	ch := database.New()
+	ch.SetDSN(c.ClickhouseRestoreConn)
+	ch.SetContext(ctx)
+	if len(c.ClusterName) > 0 {
+		selected, err := setupCluster(c.ClickhouseRestoreConn)
+		if err != nil {
+			return err
+		}
+		if !selected {
+			log.Printf("Cluster: other replica restore %s, skip", c.TaskArgs.ShardDir)
+			return nil
+		}
+	}
 	bi, err := GetMetaForRestore()
 	if err != nil {
 		s := status.New()
@@ -59,9 +74,16 @@ func Restore() error {
 		return err
 	}
 	log.Printf("Restore Job Name: %s", c.TaskArgs.JobName)
-	ch := database.New()
-	ch.SetDSN(c.ClickhouseRestoreConn)
+	err = checkConflictPolicy()
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailRestore)
+		return err
+	}
 	ch.SetMetaOpts(c.ClickhouseRestoreOpts)
+	if c.ClickhouseRestoreOpts.CutReplicated && len(c.ClickhouseRestoreOpts.ReplicatedZkPath) > 0 {
+		log.Println("replace_replicated_to_default is set, replicated_zookeeper_path ignored")
+	}
 	defer ch.Close()
 	err = CheckStorage()
 	if err != nil {
@@ -69,9 +91,30 @@ func Restore() error {
 		s.SetStatus(status.FailClickhouseStorage)
 		return err
 	}
+	startupCleanup(ctx)
+	err = checkServerCompatible(bi)
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailClickhouseStorage)
+		return err
+	}
+	restorePlacement, err = newPlacement()
+	if err != nil {
+		log.Printf("Get storage policies error: %v, parts restored to backup disks", err)
+	}
+	err = checkRestoreSpace(bi, restorePlacement)
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailClickhouseStorage)
+		return err
+	}
 	switch bi.Version {
 	case 1:
-		return Restorev1(bi)
+		err = Restorev1(ctx, bi)
+		if err == nil && !status.New().HasFails() {
+			journalRemove()
+		}
+		return err
 	case 2:
 		return Restorev2(bi)
 	default:
@@ -79,126 +122,231 @@ func Restore() error {
 	}
 }
 
+// needRestore database (table empty) or table selected by restore_filter patterns and not excluded
 func needRestore(db, table string) bool {
 	c := config.New()
-	restoreFilter := c.RestoreFilter
-	if restoreFilter == nil { // Filter not exists, restore all
-		return true
-	}
-	// Database exists in Filter?
-	if tables, ok := restoreFilter[db]; !ok {
-		return false
-	} else {
-		if len(table) < 1 { // Null table name request
-			return true
-		}
-		if len(tables) < 1 { // Filter for all tables
-			return true
-		} else { // Filter for some tables
-			if Contains(tables, table) {
-				return true
-			}
-			return false
-		}
-	}
+	return filterMatch(c.RestoreFilter, c.RestoreExclude, db, table)
 }
 
-func Restorev1(bi *backupInfo) error {
+func Restorev1(ctx context.Context, bi *backupInfo) error {
 	ch := database.New()
-	c := config.New()
 	log.Print("Restore backup: \n" + bi.String())
+	var tables []restoreItem
 	for db, dbInfo := range bi.DBS {
 		if !needRestore(db, "") {
 			continue
 		}
-		err := ch.CreateDatabase(db)
+		rdb, _ := ch.RestoreName(db, "")
+		var err error
+		if !config.New().TaskArgs.DataOnly {
+			err = ch.CreateDatabase(rdb)
+		}
 		if err != nil {
 			s := status.New()
 			s.SetStatus(status.FailRestoreDatabase)
 			log.Printf("Create database error: %v", err)
+			report.New().Error(rdb, "", "", err)
 		}
-		dbProps, err := ch.GetDBProps(db)
-		println(dbProps)
+		_, err = ch.GetDBProps(rdb)
 		if err != nil {
 			s := status.New()
 			s.SetStatus(status.FailRestoreDatabase)
 			log.Printf("Get database prefs error: %v", err)
+			report.New().Error(rdb, "", "", err)
 		}
-
-		for table, tableInfo := range dbInfo.Tables {
-			if !needRestore(db, table) {
-				continue
+		for table := range dbInfo.Tables {
+			if needRestore(db, table) {
+				tables = append(tables, restoreItem{db: db, table: table})
 			}
-			if len(tableInfo.DbDir) < 1 {
-				tableInfo.DbDir = db
-			}
-			if len(tableInfo.TableDir) < 1 {
-				tableInfo.TableDir = table
-			}
-			mi := bi.DBS[db].Tables[table].MetaData
-			mf := transport.MetaFile{
-				Name:     tableInfo.TableDir + ".sql",
-				Path:     tableInfo.DbDir,
-				JobName:  c.TaskArgs.JobName,
-				TryRetry: false,
-				Sha1:     mi.Sha1,
-			}
-			tr, err := transport.MakeTransport()
-			if err != nil {
-				return err
-			}
-			err = tr.ReadMeta(&mf)
-			if err != nil {
-				s := status.New()
-				s.SetStatus(status.FailRestoreMeta)
-				log.Println(err)
-			}
-			if mi.Sha1 != mf.Sha1 {
-				s := status.New()
-				s.SetStatus(status.FailRestoreMeta)
-				log.Printf("Backup Info SHA1: %s not eq Restored file SHA1: %s", mi.Sha1, mf.Sha1)
-			}
-			err = ch.CreateTable(db, table, mf.Content.String())
+		}
+	}
+	return restoreTables(ctx, bi, tables)
+}
+
+// restoreOneTable create table, restore files by shared file pool and attach partitions
+func restoreOneTable(ctx context.Context, jobsChan chan<- workerpool.TaskElem, bi *backupInfo, db, table string) error {
+	ch := database.New()
+	c := config.New()
+	tableInfo := bi.DBS[db].Tables[table]
+	tableInfo.defaultDirs(db, table)
+	tdb, ttable := ch.RestoreName(db, table)
+	selector := restorePartitionSelector(db, table)
+	if len(selector) > 0 {
+		err := selectRestoreParts(&tableInfo, selector)
+		if err != nil {
+			return addTableResult(tdb, ttable, err)
+		}
+		if len(tableInfo.Dirs) < 1 {
+			log.Printf("Restore `%s`.`%s` no parts for selector `%s`, skip", tdb, ttable, selector)
+			addTableSkipped(tdb, ttable, "no parts for restore selector "+selector)
+			return nil
+		}
+		log.Printf("Restore `%s`.`%s` parts: %v", tdb, ttable, tableInfo.Dirs)
+	}
+	mi := bi.DBS[db].Tables[table].MetaData
+	mf := transport.MetaFile{
+		Name:     tableInfo.TableDir + ".sql",
+		Path:     tableInfo.DbDir,
+		JobName:  c.TaskArgs.JobName,
+		TryRetry: false,
+		Sha1:     mi.Sha1,
+	}
+	rdb, _ := ch.RestoreName(db, "")
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return err
+	}
+	err = tr.ReadMeta(&mf)
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailRestoreMeta)
+		log.Println(err)
+		report.New().Error(tdb, ttable, mf.Name, err)
+	}
+	if mi.Sha1 != mf.Sha1 {
+		s := status.New()
+		s.SetStatus(status.FailRestoreMeta)
+		log.Printf("Backup Info SHA1: %s not eq Restored file SHA1: %s", mi.Sha1, mf.Sha1)
+		report.New().Error(tdb, ttable, mf.Name, fmt.Errorf("SHA1 %s not eq backup info SHA1 %s", mf.Sha1, mi.Sha1))
+	}
+	reason, err := resolveTableConflict(tdb, ttable)
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailRestoreTable)
+		log.Println(err)
+		return addTableResult(tdb, ttable, err)
+	}
+	if len(reason) > 0 {
+		addTableSkipped(tdb, ttable, reason)
+		return nil
+	}
+	if tdb != rdb && !c.TaskArgs.DataOnly {
+		err = ch.CreateDatabase(tdb)
+		if err != nil {
+			s := status.New()
+			s.SetStatus(status.FailRestoreDatabase)
+			log.Printf("Create database error: %v", err)
+			report.New().Error(tdb, "", "", err)
+		}
+	}
+	var tableErr error
+	existed := true
+	if stagingEnabled() {
+		existed, err = ch.TableExists(tdb, ttable)
+		if err != nil {
+			return addTableResult(tdb, ttable, err)
+		}
+	}
+	if c.TaskArgs.DataOnly {
+		err = checkTableSchema(tdb, ttable, mf.Content.String())
+		if err != nil {
+			s := status.New()
+			s.SetStatus(status.FailRestoreTable)
+			log.Printf("Data only restore `%s`.`%s`: %v", tdb, ttable, err)
+			return addTableResult(tdb, ttable, err)
+		}
+	} else {
+		err = ch.CreateTable(db, table, mf.Content.String())
+	}
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailRestoreTable)
+		log.Println(err)
+		tableErr = err
+	}
+	tm, err := ch.GetTableInfo(tdb, ttable)
+	if err != nil {
+		s := status.New()
+		s.SetStatus(status.FailRestoreTable)
+		log.Println(err)
+		return addTableResult(tdb, ttable, err)
+	}
+	if stagingEnabled() {
+		if tableErr != nil {
+			return addTableResult(tdb, ttable, tableErr)
+		}
+		return restoreStaged(ctx, jobsChan, db, table, mf.Content.String(), tm, &tableInfo, selector, !existed)
+	}
+	restoreTable(ctx, jobsChan, tm, &tableInfo)
+	if ctx.Err() != nil {
+		log.Printf("Restore `%s`.`%s` cancelled, parts not attached", tdb, ttable)
+		return addTableResult(tdb, ttable, ctx.Err())
+	}
+	err = attachRestored(tdb, ttable, &tableInfo, selector)
+	if err != nil {
+		return addTableResult(tdb, ttable, err)
+	}
+	return addTableResult(tdb, ttable, tableErr)
+}
+
+// attachRestored replace partitions by on_conflict and attach restored parts,
+// partitions of table not dropped and parts not attached if some files failed
+func attachRestored(tdb, ttable string, tableInfo *tableInfo, selector string) error {
+	if failed := report.New().Failed(tdb, ttable); len(failed) > 0 {
+		status.New().SetStatus(status.FailRestorePartition)
+		log.Printf("Restore `%s`.`%s` has failed files, partitions not replaced, parts not attached", tdb, ttable)
+		return errFailedFiles
+	}
+	err := replacePartitions(tdb, ttable, tableInfo)
+	if err != nil {
+		status.New().SetStatus(status.FailRestorePartition)
+		log.Printf("Replace partitions `%s`.`%s` error: %v, parts not attached", tdb, ttable, err)
+		return err
+	}
+	attachParts(tdb, ttable, tableInfo, selector)
+	return nil
+}
+
+// attachParts attach restored parts from detached, selected parts by part name,
+// returns last attach error, all errors reported
+func attachParts(tdb, ttable string, tableInfo *tableInfo, selector string) error {
+	ch := database.New()
+	var lastErr error
+	if len(selector) > 0 {
+		for _, dir := range tableInfo.Dirs {
+			err := ch.AttachPart(tdb, ttable, dir)
 			if err != nil {
 				s := status.New()
-				s.SetStatus(status.FailRestoreTable)
-				log.Println(err)
+				s.SetStatus(status.FailRestorePartition)
+				log.Printf("Error Attach part `%s`.`%s`.%s", tdb, ttable, dir)
+				report.New().Error(tdb, ttable, "part "+dir, err)
+				lastErr = err
 			}
-			tm, err := ch.GetTableInfo(db, table)
+		}
+	} else if len(tableInfo.Partitions) == 1 && tableInfo.Partitions[0] == "tuple()" {
+		for _, dir := range tableInfo.Dirs {
+			err := ch.AttachPartitionByDir(tdb, ttable, dir)
 			if err != nil {
 				s := status.New()
-				s.SetStatus(status.FailRestoreTable)
-				log.Println(err)
-				return err
+				s.SetStatus(status.FailRestorePartition)
+				log.Printf("Error Attach dir `%s`.`%s`.%s", tdb, ttable, dir)
+				report.New().Error(tdb, ttable, "dir "+dir, err)
+				lastErr = err
 			}
-			err = restoreTable(tm, &tableInfo)
+		}
+	} else {
+		for _, part := range tableInfo.Partitions {
+			err := ch.AttachPartition(tdb, ttable, part)
 			if err != nil {
 				s := status.New()
-				s.SetStatus(status.FailRestoreTable)
-				log.Println(err)
-			}
-			if len(tableInfo.Partitions) == 1 && tableInfo.Partitions[0] == "tuple()" {
-				for _, dir := range tableInfo.Dirs {
-					err = ch.AttachPartitionByDir(db, table, dir)
-					if err != nil {
-						s := status.New()
-						s.SetStatus(status.FailRestorePartition)
-						log.Printf("Error Attach dir `%s`.`%s`.%s", db, table, dir)
-					}
-				}
-			} else {
-				for _, part := range tableInfo.Partitions {
-					err = ch.AttachPartition(db, table, part)
-					if err != nil {
-						s := status.New()
-						s.SetStatus(status.FailRestorePartition)
-						log.Printf("Error Attach partition `%s`.`%s`.%s", db, table, part)
-					}
-				}
+				s.SetStatus(status.FailRestorePartition)
+				log.Printf("Error Attach partition `%s`.`%s`.%s", tdb, ttable, part)
+				report.New().Error(tdb, ttable, "partition "+part, err)
+				lastErr = err
 			}
 		}
 	}
-	return nil
+	return lastErr
+}
+
+// checkTableSchema existing table columns, sorting and partition keys must match backup DDL
+func checkTableSchema(db, table, meta string) error {
+	ch := database.New()
+	current, err := ch.ShowCreateTable(db, table)
+	if err != nil {
+		return err
+	}
+	return database.CompareSchema(meta, current)
 }
 
 func Restorev2(bi *backupInfo) error {
@@ -211,79 +359,80 @@ func getRestoreObjects() (map[string][]string, error) {
 	return restoreObjects, nil
 }
 
-func restoreTable(tm database.TableInfo, ti *tableInfo) error {
-	c := config.New()
-	var wpTask workerpool.TaskFunc = func(i interface{}) (interface{}, error) {
-		field, _ := i.(transport.CliFile)
-		return RestoreRun(field)
-	}
-	wp := workerpool.MakeWorkerPool(wpTask, c.WorkerPool.NumWorkers, c.WorkerPool.NumRetry, c.WorkerPool.ChanLen)
-	wp.Start()
-	go RestoreFiles(ti, tm, wp.GetJobsChan())
-	for job := range wp.GetResultsChan() {
-		_, _ = job.(transport.CliFile)
-	}
-	return nil
+// restoreTable send table files into shared file pool and wait them
+func restoreTable(ctx context.Context, jobsChan chan<- workerpool.TaskElem, tm database.TableInfo, ti *tableInfo) {
+	tj := &tableJob{db: tm.DBName, table: tm.TableName}
+	RestoreFiles(ctx, ti, tm, func(cf transport.CliFile) {
+		tj.wg.Add(1)
+		jobsChan <- &fileJob{cf: cf, table: tj}
+	})
+	tj.wg.Wait()
 }
 
-func RestoreFiles(ti *tableInfo, tm database.TableInfo, jobsChan chan<- workerpool.TaskElem) {
+// RestoreFiles send files of table to restore
+func RestoreFiles(ctx context.Context, ti *tableInfo, tm database.TableInfo, send func(transport.CliFile)) {
+	disks := restorePlacement.planPlacement(ti, tm)
 	for file, fileInfo := range ti.Files {
+		if ctx.Err() != nil {
+			break
+		}
 		cliF := transport.CliFile{
 			Name:       file,
 			Path:       tm.GetShortPath(),
-			DBName:     tm.DBName,
-			TableName:  tm.TableName,
+			DBName:     ti.DbDir,
+			TableName:  ti.TableDir,
 			RunJobType: transport.Restore,
 			TryRetry:   false,
 			Sha1:       fileInfo.Sha1,
 			Size:       fileInfo.Size,
 			BSize:      fileInfo.BSize,
 			Reference:  fileInfo.Reference,
+			RefPath:    fileInfo.RefPath,
 			Storage:    fileInfo.Storage,
+			Disk:       disks[PartDir(file)],
+		}
+		dest, err := cliF.RestoreDest()
+		if err != nil {
+			status.New().SetStatus(status.FailRestoreFile)
+			log.Printf("ERR: Restore archive: %s: %v", cliF.Archive(), err)
+			report.New().Error(tm.DBName, tm.TableName, file, err)
+			continue
 		}
-		if len(cliF.RestoreDest()) > 0 {
-			log.Printf("Restore archive: %s to %s", cliF.Archive(), cliF.RestoreDest())
-			jobsChan <- cliF
+		if len(dest) > 0 {
+			partDir, _ := cliF.RestorePartDir()
+			journalAdd(partDir)
+			log.Printf("Restore archive: %s to %s", cliF.Archive(), dest)
+			send(cliF)
 		} else {
 			log.Printf("ERR: Restore archive: %s, restore dest is NULL", cliF.Archive())
 		}
 	}
-	close(jobsChan)
 }
 
-func RestoreRun(cf transport.CliFile) (transport.CliFile, error) {
-	for {
-		tr, err := transport.MakeTransport()
-		if err != nil {
-			return cf, err
-		}
-		trStat, err := tr.Do(cf)
-		if err != nil {
-			if err == os.ErrNotExist {
-				log.Printf("File not Exists %s %s", err, cf.Archive())
-				s := status.New()
-				s.SetStatus(status.FailRestoreFile)
-				return cf, err
-			}
-			log.Printf("Error open storage file %s Retry. Err: %v", cf.Archive(), err)
-			time.Sleep(time.Second * 5)
-			continue
-		}
-		// Add copied check
-		if err != nil {
-			log.Printf("Error cp file %s,%s, retry", cf.Archive(), cf.RestoreDest())
-			time.Sleep(time.Second * 5)
-			//tr.Close()
-			continue
-		}
-		restoredSha1 := trStat.Sha1Sum
-		if restoredSha1 != cf.Sha1 {
-			s := status.New()
-			s.SetStatus(status.FailRestoreFile)
-			log.Printf("File %s sha1 failed %s/%s", cf.RestoreDest(), cf.Sha1, restoredSha1)
+// RestoreRun This func Running in Worker Pool, one attempt, pool retries it
+func RestoreRun(ctx context.Context, cf transport.CliFile) (transport.CliFile, error) {
+	if ctx.Err() != nil {
+		return cf, ctx.Err()
+	}
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return cf, workerpool.Permanent(err)
+	}
+	trStat, err := tr.Do(ctx, cf)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("Restore file %s aborted", cf.Archive())
+			return cf, ctx.Err()
 		}
-		return cf, nil
+		log.Printf("Error restore file %s: %v", cf.Archive(), err)
+		return cf, err
+	}
+	restoredSha1 := trStat.Sha1Sum
+	if restoredSha1 != cf.Sha1 {
+		log.Printf("File %s sha1 failed %s/%s", cf.Archive(), cf.Sha1, restoredSha1)
+		return cf, fmt.Errorf("SHA1 %s not eq backup info SHA1 %s", restoredSha1, cf.Sha1)
 	}
+	return cf, nil
 }
 
 func BackupRead(backupName string) (*backupInfo, error) {
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"cliback/report"
+	"cliback/transport"
+	"context"
+	"errors"
+)
+
+var errFailedFiles = errors.New("Some files failed")
+
+func outcome(err error) string {
+	switch err {
+	case nil:
+		return report.OutcomeOK
+	case context.Canceled:
+		return report.OutcomeCancelled
+	}
+	return report.OutcomeFailed
+}
+
+// addFileResult report file result, db and table are real names, not escaped dirs
+func addFileResult(db, table string, cf transport.CliFile, err error) {
+	res := report.Result{
+		Database: db,
+		Table:    table,
+		File:     cf.Name,
+		Outcome:  outcome(err),
+		Retries:  cf.Retries,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	report.New().Add(res)
+}
+
+// addTableSkipped report table skipped with reason
+func addTableSkipped(db, table, reason string) {
+	report.New().Add(report.Result{
+		Database: db,
+		Table:    table,
+		Outcome:  report.OutcomeSkipped,
+		Error:    reason,
+	})
+}
+
+// addTableResult report table result, table failed if some files failed
+func addTableResult(db, table string, err error) error {
+	res := report.Result{
+		Database: db,
+		Table:    table,
+		Outcome:  outcome(err),
+	}
+	if err != nil {
+		res.Error = err.Error()
+	} else if failed := report.New().Failed(db, table); len(failed) > 0 {
+		res.Outcome = report.OutcomeFailed
+		res.Error = errFailedFiles.Error()
+		err = errFailedFiles
+	}
+	report.New().Add(res)
+	return err
+}
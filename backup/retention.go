@@ -47,6 +47,15 @@ func retentionCleanup() error {
 			}
 			continue
 		}
+		if state := BackupState(bi); state != BackupStatusComplete {
+			if maybeRunning(bi) {
+				log.Println("Retention: ", backupName, "is running now, skip")
+				continue
+			}
+			log.Println("Retention: ", backupName, state, "Added to BadBackups")
+			badBackups = append(badBackups, backupName)
+			continue
+		}
 		bm.Add(bi.Name, bi.Reference...)
 	}
 	log.Println("Retention: Walk storage ends")
@@ -55,6 +64,7 @@ func retentionCleanup() error {
 	// log.Println("Retention: Deps Backward:", bm.GetDepsBackward())
 	log.Println("Retention: Bad deps:", bm.GetBadDeps())
 	log.Println("Retention: Fulls for Delete:", bm.GetFullsForDelete(c.RetentionBackupFull))
+	log.Println("Retention: Schemas for Delete:", bm.GetSchemasForDelete(c.RetentionBackupFull))
 	log.Println("Retention: Backups for Delete:", bm.GetBackupsForDelete(c.RetentionBackupFull))
 	log.Println("Retention: Fulls for Store:", bm.GetFullsForStore(c.RetentionBackupFull))
 	log.Println("Retention: Backups for Store:", bm.GetBackupsForStore(c.RetentionBackupFull))
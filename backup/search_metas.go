@@ -3,6 +3,8 @@ package backup
 import (
 	"cliback/transport"
 	"errors"
+	"fmt"
+	"path"
 	"regexp"
 	"sort"
 	"sync"
@@ -11,6 +13,36 @@ import (
 type previousBackups struct {
 	backupInfos []*backupInfo
 	founded     bool
+	index       map[string]fileRef
+	statIndex   map[string]fileRef
+	partIndex   map[string]partRef
+}
+
+// partRef part stored in previous backups, files reference stored backups
+type partRef struct {
+	Backup string
+	Files  map[string]fileInfo
+}
+
+func partKey(db, table, name, hash, mtime string) string {
+	return fmt.Sprintf("%s.%s:%s:%s:%s", db, table, name, hash, mtime)
+}
+
+// fileRef file stored in previous backup
+type fileRef struct {
+	Backup string
+	Path   string // db_dir/table_dir/name
+	Size   int64
+	BSize  int64
+	Sha1   string
+}
+
+func refKey(sha1 string, size int64) string {
+	return fmt.Sprintf("%s:%d", sha1, size)
+}
+
+func statKey(filePath string, size, mtime int64) string {
+	return fmt.Sprintf("%s:%d:%d", filePath, size, mtime)
 }
 
 var (
@@ -41,9 +73,9 @@ func (pb *previousBackups) Search(t string) error {
 	var resultChain []*backupInfo
 	// Search Full Backup
 	var fullBackupPos int
-	for i := len(metas) - 1; i > 0; i-- {
+	for i := len(metas) - 1; i >= 0; i-- {
 		if reMatch, _ := regexp.MatchString("^(\\d{8}_\\d{6}[F]{1})$", metas[i]); reMatch {
-			meta, err := BackupRead(metas[i])
+			meta, err := BackupReadComplete(metas[i])
 			if err != nil {
 				continue
 			}
@@ -59,13 +91,15 @@ func (pb *previousBackups) Search(t string) error {
 	pb.founded = true
 	if t == "diff" {
 		pb.backupInfos = resultChain
+		pb.buildIndex()
+		return nil
 	}
 	for i := fullBackupPos + 1; i < len(metas); i++ {
 		if reMatch, _ := regexp.MatchString("^(\\d{8}_\\d{6}[F]{1})$", metas[i]); reMatch {
 			break
 		}
 		if reMatch, _ := regexp.MatchString("^(\\d{8}_\\d{6}[DI]{1})$", metas[i]); reMatch {
-			meta, err := BackupRead(metas[i])
+			meta, err := BackupReadComplete(metas[i])
 			if err != nil {
 				continue
 			}
@@ -73,9 +107,107 @@ func (pb *previousBackups) Search(t string) error {
 		}
 	}
 	pb.backupInfos = resultChain
+	pb.buildIndex()
 	return nil
 }
 
+// buildIndex index files stored in chain by content, newer backup wins
+func (pb *previousBackups) buildIndex() {
+	pb.index = map[string]fileRef{}
+	pb.statIndex = map[string]fileRef{}
+	pb.partIndex = map[string]partRef{}
+	for _, bi := range pb.backupInfos {
+		for db, di := range bi.DBS {
+			for table, ti := range di.Tables {
+				dbDir, tableDir := ti.DbDir, ti.TableDir
+				if len(dbDir) < 1 {
+					dbDir = db
+				}
+				if len(tableDir) < 1 {
+					tableDir = table
+				}
+				for name, fi := range ti.Files {
+					if len(fi.Sha1) < 1 {
+						continue
+					}
+					ref := fileRef{
+						Backup: bi.Name,
+						Path:   path.Join(dbDir, tableDir, name),
+						Size:   fi.Size,
+						BSize:  fi.BSize,
+						Sha1:   fi.Sha1,
+					}
+					if len(fi.Reference) > 0 {
+						// stat of referenced file points to stored one
+						ref.Backup = fi.Reference
+						if len(fi.RefPath) > 0 {
+							ref.Path = fi.RefPath
+						}
+					} else {
+						pb.index[refKey(fi.Sha1, fi.Size)] = ref
+					}
+					if fi.MTime > 0 {
+						pb.statIndex[statKey(path.Join(dbDir, tableDir, name), fi.Size, fi.MTime)] = ref
+					}
+				}
+				pb.indexParts(bi, db, table, &ti)
+			}
+		}
+	}
+}
+
+// indexParts index parts of table with files resolved to stored backups
+func (pb *previousBackups) indexParts(bi *backupInfo, db, table string, ti *tableInfo) {
+	if len(ti.Parts) < 1 {
+		return
+	}
+	files := map[string]map[string]fileInfo{}
+	for name, fi := range ti.Files {
+		part := PartDir(name)
+		if _, ok := ti.Parts[part]; !ok {
+			continue
+		}
+		if len(fi.Reference) < 1 {
+			fi.Reference = bi.Name
+		}
+		if files[part] == nil {
+			files[part] = map[string]fileInfo{}
+		}
+		files[part][name] = fi
+	}
+	for name, p := range ti.Parts {
+		if len(p.Hash) < 1 || len(files[name]) < 1 {
+			continue
+		}
+		backup := p.Reference
+		if len(backup) < 1 {
+			backup = bi.Name
+		}
+		pb.partIndex[partKey(db, table, name, p.Hash, p.ModificationTime)] = partRef{
+			Backup: backup,
+			Files:  files[name],
+		}
+	}
+}
+
+// LookupPart part with same name, hash and modification time in previous backups
+func (pb *previousBackups) LookupPart(db, table, name, hash, mtime string) (partRef, bool) {
+	ref, ok := pb.partIndex[partKey(db, table, name, hash, mtime)]
+	return ref, ok
+}
+
+// LookupStat file with same path, size and mtime in previous backups
+func (pb *previousBackups) LookupStat(filePath string, size, mtime int64) (fileRef, bool) {
+	ref, ok := pb.statIndex[statKey(filePath, size, mtime)]
+	return ref, ok
+}
+
+// Lookup file with same content in previous backups
+func (pb *previousBackups) Lookup(sha1 string, size int64) (fileRef, bool) {
+	ref, ok := pb.index[refKey(sha1, size)]
+	return ref, ok
+}
+
 func (pb *previousBackups) GetBackupNames() []string {
 	var result []string
 	for _, bi := range pb.backupInfos {
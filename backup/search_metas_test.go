@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/transport"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPreviousBackupsIndex(t *testing.T) {
+	full := &backupInfo{Name: "20210101_000000F", DBS: map[string]databaseInfo{
+		"db": {Tables: map[string]tableInfo{
+			"t": {DbDir: "db", TableDir: "t", Files: map[string]fileInfo{
+				"all_1_1_0/data.bin": {Sha1: "aaa", Size: 10, BSize: 5, MTime: 1000},
+				"all_2_2_0/data.bin": {Sha1: "bbb", Size: 20, BSize: 7},
+			}},
+		}},
+	}}
+	incr := &backupInfo{Name: "20210102_000000I", DBS: map[string]databaseInfo{
+		"db": {Tables: map[string]tableInfo{
+			"t": {DbDir: "db", TableDir: "t", Files: map[string]fileInfo{
+				// merged part, same content as all_1_1_0 stored by reference
+				"all_1_2_1/data.bin": {Sha1: "aaa", Size: 10, BSize: 5, Reference: "20210101_000000F"},
+				"all_3_3_0/data.bin": {Sha1: "bbb", Size: 20, BSize: 8},
+				"all_4_4_0/data.bin": {Sha1: "ccc", Size: 30, BSize: 9, MTime: 2000,
+					Reference: "20210101_000000F", RefPath: "db/t/all_0_0_0/data.bin"},
+			}},
+		}},
+	}}
+	pb := &previousBackups{backupInfos: []*backupInfo{full, incr}}
+	pb.buildIndex()
+
+	ref, ok := pb.Lookup("aaa", 10)
+	if !ok || ref.Backup != full.Name || ref.Path != "db/t/all_1_1_0/data.bin" {
+		t.Errorf("bad ref for aaa: %+v %v", ref, ok)
+	}
+	ref, ok = pb.Lookup("bbb", 20)
+	if !ok || ref.Backup != incr.Name || ref.Path != "db/t/all_3_3_0/data.bin" || ref.BSize != 8 {
+		t.Errorf("newer stored file must win for bbb: %+v %v", ref, ok)
+	}
+	if _, ok := pb.Lookup("aaa", 11); ok {
+		t.Errorf("size must be part of key")
+	}
+	if _, ok := pb.Lookup("ccc", 30); ok {
+		t.Errorf("referenced file must not be content indexed")
+	}
+
+	ref, ok = pb.LookupStat("db/t/all_1_1_0/data.bin", 10, 1000)
+	if !ok || ref.Sha1 != "aaa" || ref.Backup != full.Name {
+		t.Errorf("bad stat ref: %+v %v", ref, ok)
+	}
+	if _, ok := pb.LookupStat("db/t/all_1_1_0/data.bin", 10, 1001); ok {
+		t.Errorf("mtime must be part of stat key")
+	}
+	ref, ok = pb.LookupStat("db/t/all_4_4_0/data.bin", 30, 2000)
+	if !ok || ref.Backup != full.Name || ref.Path != "db/t/all_0_0_0/data.bin" || ref.Sha1 != "ccc" {
+		t.Errorf("stat of referenced file must point to stored file: %+v %v", ref, ok)
+	}
+}
+
+func TestPreviousBackupsPartIndex(t *testing.T) {
+	full := &backupInfo{Name: "20210101_000000F", DBS: map[string]databaseInfo{
+		"db": {Tables: map[string]tableInfo{
+			"t": {DbDir: "db", TableDir: "t",
+				Files: map[string]fileInfo{
+					"all_1_1_0/data.bin": {Sha1: "aaa", Size: 10},
+					"all_1_1_0/data.mrk": {Sha1: "bbb", Size: 2},
+				},
+				Parts: map[string]partInfo{"all_1_1_0": {Hash: "h1", ModificationTime: "2021-01-01 00:00:00"}},
+			},
+		}},
+	}}
+	incr := &backupInfo{Name: "20210102_000000I", DBS: map[string]databaseInfo{
+		"db": {Tables: map[string]tableInfo{
+			"t": {DbDir: "db", TableDir: "t",
+				Files: map[string]fileInfo{
+					"all_1_1_0/data.bin": {Sha1: "aaa", Size: 10, Reference: full.Name},
+					"all_1_1_0/data.mrk": {Sha1: "bbb", Size: 2, Reference: full.Name},
+					"all_2_2_0/data.bin": {Sha1: "ccc", Size: 30},
+				},
+				Parts: map[string]partInfo{
+					"all_1_1_0": {Hash: "h1", ModificationTime: "2021-01-01 00:00:00", Reference: full.Name},
+					"all_2_2_0": {Hash: "h2", ModificationTime: "2021-01-02 00:00:00"},
+				},
+			},
+		}},
+	}}
+	pb := &previousBackups{backupInfos: []*backupInfo{full, incr}}
+	pb.buildIndex()
+
+	ref, ok := pb.LookupPart("db", "t", "all_1_1_0", "h1", "2021-01-01 00:00:00")
+	if !ok || ref.Backup != full.Name || len(ref.Files) != 2 {
+		t.Fatalf("bad ref for all_1_1_0: %+v %v", ref, ok)
+	}
+	if ref.Files["all_1_1_0/data.bin"].Reference != full.Name {
+		t.Errorf("file must reference stored backup: %+v", ref.Files)
+	}
+	ref, ok = pb.LookupPart("db", "t", "all_2_2_0", "h2", "2021-01-02 00:00:00")
+	if !ok || ref.Backup != incr.Name || ref.Files["all_2_2_0/data.bin"].Reference != incr.Name {
+		t.Errorf("bad ref for all_2_2_0: %+v %v", ref, ok)
+	}
+	if _, ok = pb.LookupPart("db", "t", "all_2_2_0", "h3", "2021-01-02 00:00:00"); ok {
+		t.Errorf("changed part must not be found")
+	}
+}
+
+func TestSearchFirstFullBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.New()
+	defer func(storage string, backupDir string) {
+		c.BackupStorage.Type, c.BackupStorage.BackupDir = storage, backupDir
+	}(c.BackupStorage.Type, c.BackupStorage.BackupDir)
+	c.BackupStorage.Type = "local"
+	c.BackupStorage.BackupDir = dir
+
+	// only backup in storage is first of list
+	content, err := json.Marshal(backupInfo{Name: "20210101_000000F", Type: "full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf := transport.MetaFile{Name: "backup.json", JobName: "20210101_000000F"}
+	mf.Content.Write(content)
+	if err := tr.WriteMeta(&mf); err != nil {
+		t.Fatal(err)
+	}
+	pb := &previousBackups{}
+	if err := pb.Search("diff"); err != nil {
+		t.Fatal(err)
+	}
+	if names := pb.GetBackupNames(); len(names) != 1 || names[0] != "20210101_000000F" {
+		t.Errorf("previous backups %v", names)
+	}
+}
@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type serverInfo struct {
+	HostName        string                         `json:"hostname"`
+	Version         string                         `json:"version"`
+	Timezone        string                         `json:"timezone"`
+	Disks           map[string]string              `json:"disks"`
+	StoragePolicies map[string]map[string][]string `json:"storage_policies"`
+	CliBackVersion  string                         `json:"cliback_version"`
+}
+
+func getServerInfo() (*serverInfo, error) {
+	c := config.New()
+	ch := database.New()
+	si := &serverInfo{CliBackVersion: c.TaskArgs.Version}
+	srv, err := ch.GetServerInfo()
+	if err != nil {
+		return si, err
+	}
+	si.HostName = srv.HostName
+	si.Version = srv.Version
+	si.Timezone = srv.Timezone
+	si.Disks, err = ch.GetDisks()
+	if err != nil {
+		return si, err
+	}
+	si.StoragePolicies, err = ch.GetStoragePolicies()
+	if err != nil {
+		return si, err
+	}
+	return si, nil
+}
+
+// compareVersions compare Clickhouse versions like 21.3.4.25, returns -1, 0, 1
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		if an < bn {
+			return -1
+		}
+		if an > bn {
+			return 1
+		}
+	}
+	return 0
+}
+
+// policyPlaced tells whether restore placement has configured disk of policy on target
+func policyPlaced(policy string, target *serverInfo) bool {
+	c := config.New()
+	for _, disks := range target.StoragePolicies[policy] {
+		for _, d := range disks {
+			if _, ok := c.ClickhouseStorage[d]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serverProblems returns incompatibilities of restore server with backuped server
+func serverProblems(bi *backupInfo, target *serverInfo) []string {
+	var problems []string
+	c := config.New()
+	source := bi.Server
+	if compareVersions(target.Version, source.Version) < 0 {
+		problems = append(problems, fmt.Sprintf("server version %s older then backup source version %s", target.Version, source.Version))
+	}
+	if len(source.Timezone) > 0 && source.Timezone != target.Timezone {
+		log.Printf("Server check: timezone %s differs from backup source timezone %s", target.Timezone, source.Timezone)
+	}
+	var storages, policies []string
+	ch := database.New()
+	for db, di := range bi.DBS {
+		for table, ti := range di.Tables {
+			if !needRestore(db, table) {
+				continue
+			}
+			// backups before storage_policy was saved have no policy, not checked
+			if len(ti.Policy) > 0 {
+				policy := ch.RestoreStoragePolicy(db, table, ti.Policy)
+				if !Contains(policies, policy) {
+					policies = append(policies, policy)
+				}
+				if policyPlaced(policy, target) {
+					// parts placed on policy disks, backup disks not needed
+					continue
+				}
+			}
+			for _, fi := range ti.Files {
+				st := fi.Storage
+				if len(st) < 1 {
+					st = "default"
+				}
+				if !Contains(storages, st) {
+					storages = append(storages, st)
+				}
+			}
+		}
+	}
+	for _, st := range storages {
+		if mapped, ok := c.ClickhouseRestoreOpts.DiskMap[st]; ok {
+			st = mapped
+		}
+		if _, ok := c.ClickhouseStorage[st]; ok {
+			continue
+		}
+		if c.ClickhouseRestoreOpts.BadStorageToDefault {
+			log.Printf("Server check: disk %s not exists, data will be moved to default", st)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("disk %s used by backup not exists", st))
+	}
+	sort.Strings(policies)
+	for _, policy := range policies {
+		if _, ok := target.StoragePolicies[policy]; !ok {
+			problems = append(problems, fmt.Sprintf("storage policy %s used by backup not exists", policy))
+		}
+	}
+	return problems
+}
+
+// checkServerCompatible warn or fail by server_check option: warn (default), fail, skip
+func checkServerCompatible(bi *backupInfo) error {
+	c := config.New()
+	mode := c.ClickhouseRestoreOpts.ServerCheck
+	if mode == "skip" || bi.Server == nil {
+		return nil
+	}
+	target, err := getServerInfo()
+	if err != nil {
+		log.Printf("Server check: get server info error: %v", err)
+		if mode == "fail" {
+			return fmt.Errorf("Server check: get server info error: %v", err)
+		}
+		return nil
+	}
+	log.Printf("Server check: backup from %s version %s, restore to %s version %s",
+		bi.Server.HostName, bi.Server.Version, target.HostName, target.Version)
+	problems := serverProblems(bi, target)
+	for _, p := range problems {
+		log.Printf("Server check: %s", p)
+	}
+	if len(problems) > 0 && mode == "fail" {
+		return errors.New("Restore server not compatible with backup: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
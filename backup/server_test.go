@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"cliback/config"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b   string
+		expect int
+	}{
+		{"21.3.4.25", "21.3.4.25", 0},
+		{"20.8.1", "21.3.4.25", -1},
+		{"21.10.1.1", "21.9.5.2", 1},
+		{"21.3", "21.3.0.0", 0},
+	}
+	for _, tc := range cases {
+		if r := compareVersions(tc.a, tc.b); r != tc.expect {
+			t.Errorf("compareVersions(%s, %s) = %d, expect %d", tc.a, tc.b, r, tc.expect)
+		}
+	}
+}
+
+func TestServerProblemsUsedPolicies(t *testing.T) {
+	c := config.New()
+	defer func(storage map[string]string, filter map[string][]string) {
+		c.ClickhouseStorage, c.RestoreFilter = storage, filter
+	}(c.ClickhouseStorage, c.RestoreFilter)
+	c.ClickhouseStorage = map[string]string{"default": "/var/lib/clickhouse"}
+	c.RestoreFilter = nil
+
+	bi := &backupInfo{
+		Server: &serverInfo{
+			Version: "21.3.1",
+			StoragePolicies: map[string]map[string][]string{
+				"default": {"main": {"default"}},
+				"hot":     {"main": {"default"}},
+				"unused":  {"main": {"default"}},
+			},
+		},
+		DBS: map[string]databaseInfo{
+			"db": {Tables: map[string]tableInfo{
+				"t1": {Policy: "hot"},
+				"t2": {Policy: "default"},
+				"t3": {},
+			}},
+		},
+	}
+	target := &serverInfo{
+		Version:         "21.3.1",
+		StoragePolicies: map[string]map[string][]string{"default": {"main": {"default"}}},
+	}
+	problems := serverProblems(bi, target)
+	if len(problems) != 1 || !strings.Contains(problems[0], "hot") {
+		t.Errorf("problems %v, expect only policy hot", problems)
+	}
+}
+
+func TestServerProblemsPlacedDisks(t *testing.T) {
+	c := config.New()
+	defer func(storage map[string]string, filter map[string][]string, toDefault bool) {
+		c.ClickhouseStorage, c.RestoreFilter, c.ClickhouseRestoreOpts.BadStorageToDefault = storage, filter, toDefault
+	}(c.ClickhouseStorage, c.RestoreFilter, c.ClickhouseRestoreOpts.BadStorageToDefault)
+	c.ClickhouseStorage = map[string]string{"default": "/var/lib/clickhouse", "nvme": "/mnt/nvme"}
+	c.RestoreFilter = nil
+	c.ClickhouseRestoreOpts.BadStorageToDefault = false
+
+	bi := &backupInfo{
+		Server: &serverInfo{Version: "21.3.1"},
+		DBS: map[string]databaseInfo{
+			"db": {Tables: map[string]tableInfo{
+				// hot policy has nvme on target, ssd disk placed by policy
+				"t1": {Policy: "hot", Files: map[string]fileInfo{"all_1_1_0/data.bin": {Storage: "ssd"}}},
+				// no policy saved, ssd2 disk must exist
+				"t2": {Files: map[string]fileInfo{"all_1_1_0/data.bin": {Storage: "ssd2"}}},
+			}},
+		},
+	}
+	target := &serverInfo{
+		Version: "21.3.1",
+		StoragePolicies: map[string]map[string][]string{
+			"default": {"main": {"default"}},
+			"hot":     {"main": {"nvme"}},
+		},
+	}
+	problems := serverProblems(bi, target)
+	if len(problems) != 1 || !strings.Contains(problems[0], "ssd2") {
+		t.Errorf("problems %v, expect only disk ssd2", problems)
+	}
+}
@@ -0,0 +1,238 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"cliback/transport"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// checkBackupSpace estimate backup size by system.parts and check free space
+// on clickhouse disks for frozen data and on backup storage
+func checkBackupSpace(backupObjects map[string][]string) error {
+	c := config.New()
+	if c.SkipFreeSpaceCheck || schemaOnly() {
+		return nil
+	}
+	ch := database.New()
+	partsSize, err := ch.GetPartsSize()
+	if err != nil {
+		return err
+	}
+	free, err := ch.GetDisksFreeSpace()
+	if err != nil {
+		return err
+	}
+	var total int64
+	// Frozen table parts pinned while merges rewrite it, worst case is biggest table per disk
+	maxTable := map[string]int64{}
+	for _, ps := range partsSize {
+		if !Contains(backupObjects[ps.DBName], ps.TableName) {
+			continue
+		}
+		total += ps.Bytes
+		if ps.Bytes > maxTable[ps.Disk] {
+			maxTable[ps.Disk] = ps.Bytes
+		}
+	}
+	var problems []string
+	for disk, size := range maxTable {
+		if c.IsObjectDisk(disk) {
+			continue
+		}
+		if f, ok := free[disk]; ok && size > f {
+			problems = append(problems, fmt.Sprintf("disk %s free %s, shadow may need %s", disk, ByteCountIEC(f), ByteCountIEC(size)))
+		}
+	}
+	tr, err := transport.MakeTransport()
+	if err != nil {
+		return err
+	}
+	storageFree, err := tr.FreeSpace()
+	if err != nil {
+		log.Printf("Space check: get backup storage free space error: %v", err)
+	} else {
+		log.Printf("Space check: backup size estimate %s, backup storage free %s", ByteCountIEC(total), ByteCountIEC(storageFree))
+		if total > storageFree {
+			if c.TaskArgs.BackupType == "diff" || c.TaskArgs.BackupType == "incr" {
+				// Estimate is upper bound for delta backups
+				log.Printf("Space check: backup storage may be too small for %s backup", c.TaskArgs.BackupType)
+			} else {
+				problems = append(problems, fmt.Sprintf("backup storage free %s, backup needs %s", ByteCountIEC(storageFree), ByteCountIEC(total)))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("Not enough free space: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkRestoreSpace check restore disks can hold restored files, tables planned by
+// placement ledger of restore
+func checkRestoreSpace(bi *backupInfo, p *placement) error {
+	c := config.New()
+	if c.SkipFreeSpaceCheck {
+		return nil
+	}
+	if p == nil {
+		return errors.New("Disks free space not available, set skip_free_space_check to restore without check")
+	}
+	need := map[string]int64{}
+	for db, di := range bi.DBS {
+		for table, ti := range di.Tables {
+			if !needRestore(db, table) {
+				continue
+			}
+			ti.defaultDirs(db, table)
+			disks := p.planPlacement(&ti, restoreTableInfo(db, table, &ti))
+			for file, fi := range ti.Files {
+				cf := transport.CliFile{Storage: fi.Storage, Disk: disks[PartDir(file)]}
+				storage, err := cf.RestoreStorage()
+				if err != nil {
+					return fmt.Errorf("Restore `%s`.`%s`: %v", db, table, err)
+				}
+				need[storage] += fi.Size
+			}
+		}
+	}
+	var problems []string
+	for disk, size := range need {
+		if c.IsObjectDisk(disk) {
+			continue
+		}
+		log.Printf("Space check: disk %s restore %s", disk, ByteCountIEC(size))
+		if f, ok := p.free[disk]; ok && size > f {
+			problems = append(problems, fmt.Sprintf("disk %s free %s, restore needs %s", disk, ByteCountIEC(f), ByteCountIEC(size)))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("Not enough free space: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// restoreTableInfo returns restore target table, storage policy of backuped table
+// after rewrite rules for not existing table
+func restoreTableInfo(db, table string, ti *tableInfo) database.TableInfo {
+	ch := database.New()
+	tdb, ttable := ch.RestoreName(db, table)
+	if ok, err := ch.TableExists(tdb, ttable); err == nil && ok {
+		if tm, err := ch.GetTableInfo(tdb, ttable); err == nil {
+			return tm
+		}
+	}
+	return database.TableInfo{DBName: tdb, TableName: ttable, StoragePolicy: ch.RestoreStoragePolicy(db, table, ti.Policy)}
+}
+
+// shadowBudget limit frozen data of parallel tables by free space of disks
+type shadowBudget struct {
+	ctx    context.Context
+	mux    sync.Mutex
+	cond   *sync.Cond
+	free   map[string]int64
+	tables map[string]map[string]int64 // db.table -> disk -> bytes
+	frozen int
+}
+
+// newShadowBudget returns nil (no limit) for one table at once or without system tables info
+func newShadowBudget(ctx context.Context, backupObjects map[string][]string) *shadowBudget {
+	c := config.New()
+	if c.WorkerPool.NumTables < 2 || c.SkipFreeSpaceCheck {
+		return nil
+	}
+	ch := database.New()
+	partsSize, err := ch.GetPartsSize()
+	if err != nil {
+		log.Printf("Shadow budget: get parts size error: %v", err)
+		return nil
+	}
+	free, err := ch.GetDisksFreeSpace()
+	if err != nil {
+		log.Printf("Shadow budget: get disks free space error: %v", err)
+		return nil
+	}
+	sb := &shadowBudget{
+		ctx:    ctx,
+		free:   map[string]int64{},
+		tables: map[string]map[string]int64{},
+	}
+	for disk, f := range free {
+		if !c.IsObjectDisk(disk) {
+			sb.free[disk] = f
+		}
+	}
+	for _, ps := range partsSize {
+		if !Contains(backupObjects[ps.DBName], ps.TableName) {
+			continue
+		}
+		if _, ok := sb.free[ps.Disk]; !ok {
+			continue
+		}
+		key := ps.DBName + "." + ps.TableName
+		if sb.tables[key] == nil {
+			sb.tables[key] = map[string]int64{}
+		}
+		sb.tables[key][ps.Disk] += ps.Bytes
+	}
+	sb.cond = sync.NewCond(&sb.mux)
+	go func() {
+		<-ctx.Done()
+		sb.mux.Lock()
+		sb.cond.Broadcast()
+		sb.mux.Unlock()
+	}()
+	return sb
+}
+
+func (sb *shadowBudget) fits(need map[string]int64) bool {
+	if sb.frozen == 0 {
+		// single table checked by checkBackupSpace
+		return true
+	}
+	for disk, size := range need {
+		if size > sb.free[disk] {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire wait until frozen tables leave space for table
+func (sb *shadowBudget) acquire(db, table string) error {
+	if sb == nil {
+		return nil
+	}
+	need := sb.tables[db+"."+table]
+	sb.mux.Lock()
+	defer sb.mux.Unlock()
+	for !sb.fits(need) {
+		if sb.ctx.Err() != nil {
+			return sb.ctx.Err()
+		}
+		sb.cond.Wait()
+	}
+	for disk, size := range need {
+		sb.free[disk] -= size
+	}
+	sb.frozen++
+	return nil
+}
+
+func (sb *shadowBudget) release(db, table string) {
+	if sb == nil {
+		return
+	}
+	sb.mux.Lock()
+	defer sb.mux.Unlock()
+	for disk, size := range sb.tables[db+"."+table] {
+		sb.free[disk] += size
+	}
+	sb.frozen--
+	sb.cond.Broadcast()
+}
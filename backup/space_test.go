@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestShadowBudget(t *testing.T) {
+	sb := &shadowBudget{
+		ctx:  context.Background(),
+		free: map[string]int64{"default": 100},
+		tables: map[string]map[string]int64{
+			"db.big":   {"default": 150},
+			"db.small": {"default": 40},
+		},
+	}
+	sb.cond = sync.NewCond(&sb.mux)
+	// first table always fits, even bigger then free space
+	if err := sb.acquire("db", "big"); err != nil {
+		t.Fatal(err)
+	}
+	if sb.fits(sb.tables["db.small"]) {
+		t.Errorf("small table must wait while big table frozen")
+	}
+	sb.release("db", "big")
+	if err := sb.acquire("db", "small"); err != nil {
+		t.Fatal(err)
+	}
+	if !sb.fits(sb.tables["db.small"]) {
+		t.Errorf("two small tables must fit, free %d", sb.free["default"])
+	}
+	if sb.fits(sb.tables["db.big"]) {
+		t.Errorf("big table must wait while small table frozen")
+	}
+	sb.release("db", "small")
+	if sb.free["default"] != 100 || sb.frozen != 0 {
+		t.Errorf("budget not returned: free %d frozen %d", sb.free["default"], sb.frozen)
+	}
+	var nilBudget *shadowBudget
+	if err := nilBudget.acquire("db", "big"); err != nil {
+		t.Errorf("nil budget must not limit: %v", err)
+	}
+	nilBudget.release("db", "big")
+}
@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/database"
+	"cliback/report"
+	"cliback/status"
+	"cliback/workerpool"
+	"context"
+	"log"
+	"sort"
+)
+
+// stagingEnabled restore into staging table, live table changed only after all parts attached
+func stagingEnabled() bool {
+	return config.New().ClickhouseRestoreOpts.StagingRestore
+}
+
+func stagingName(table string) string {
+	return table + "_cliback_staging"
+}
+
+// restoredPartitionIDs partition ids of restored parts
+func restoredPartitionIDs(ti *tableInfo) []string {
+	seen := map[string]bool{}
+	var ids []string
+	for file := range ti.Files {
+		id := partitionID(PartDir(file))
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// restoreStaged restore files and attach parts into staging table, then move partitions
+// into live table by on_conflict policy. On failure staging dropped, live table created
+// by this restore dropped too
+func restoreStaged(ctx context.Context, jobsChan chan<- workerpool.TaskElem, db, table, meta string,
+	live database.TableInfo, ti *tableInfo, selector string, created bool) error {
+	ch := database.New()
+	tdb, ttable := live.DBName, live.TableName
+	staging := stagingName(ttable)
+	rollback := func(err error) error {
+		log.Printf("Restore `%s`.`%s` failed: %v, rollback staging", tdb, ttable, err)
+		if dropErr := ch.DropTable(tdb, staging); dropErr != nil {
+			log.Printf("Drop staging `%s`.`%s` error: %v", tdb, staging, dropErr)
+		}
+		if created {
+			if dropErr := ch.DropTable(tdb, ttable); dropErr != nil {
+				log.Printf("Drop created `%s`.`%s` error: %v", tdb, ttable, dropErr)
+			}
+		}
+		return addTableResult(tdb, ttable, err)
+	}
+	// leftover of crashed restore
+	err := ch.DropTable(tdb, staging)
+	if err != nil {
+		return rollback(err)
+	}
+	err = ch.CreateStagingTable(db, table, meta, staging)
+	if err != nil {
+		status.New().SetStatus(status.FailRestoreTable)
+		return rollback(err)
+	}
+	tm, err := ch.GetTableInfo(tdb, staging)
+	if err != nil {
+		status.New().SetStatus(status.FailRestoreTable)
+		return rollback(err)
+	}
+	restoreTable(ctx, jobsChan, tm, ti)
+	if ctx.Err() != nil {
+		return rollback(ctx.Err())
+	}
+	if failed := report.New().Failed(tdb, staging); len(failed) > 0 {
+		return rollback(errFailedFiles)
+	}
+	err = attachParts(tdb, staging, ti, selector)
+	if err != nil {
+		return rollback(err)
+	}
+	err = moveStaged(ctx, tdb, ttable, staging, live.TableEngine, restoredPartitionIDs(ti))
+	if err != nil {
+		// restored data kept in staging for manual recovery
+		status.New().SetStatus(status.FailRestorePartition)
+		log.Printf("Move staging into `%s`.`%s` error: %v, restored data kept in `%s`.`%s`", tdb, ttable, err, tdb, staging)
+		report.New().Error(tdb, ttable, "staging "+staging, err)
+		return addTableResult(tdb, ttable, err)
+	}
+	if dropErr := ch.DropTable(tdb, staging); dropErr != nil {
+		log.Printf("Drop staging `%s`.`%s` error: %v", tdb, staging, dropErr)
+	}
+	return addTableResult(tdb, ttable, nil)
+}
+
+// moveStaged move partitions of staging into live table: replace-table exchange tables
+// (non replicated) or replace restored partitions and then drop other partitions,
+// replace-partition replace restored partitions, other policies attach restored partitions.
+// On ctx cancel stopped before next partition, stale partitions not dropped
+func moveStaged(ctx context.Context, db, table, staging, engine string, ids []string) error {
+	ch := database.New()
+	policy := conflictPolicy()
+	if policy == ConflictReplaceTable && !database.IsReplicatedEngine(engine) {
+		err := ch.ExchangeTables(db, table, staging)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Exchange `%s`.`%s` error: %v, replace partitions", db, table, err)
+	}
+	var stale []string
+	if policy == ConflictReplaceTable {
+		livePartitions, err := ch.GetPartitionInfos(db, table)
+		if err != nil {
+			return err
+		}
+		for _, p := range livePartitions {
+			if !Contains(ids, p.ID) {
+				stale = append(stale, p.ID)
+			}
+		}
+	}
+	replace := policy == ConflictReplaceTable || policy == ConflictReplacePartition
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := ch.MovePartitionFrom(db, table, id, staging, replace); err != nil {
+			return err
+		}
+	}
+	// live partitions absent in backup dropped only after all restored partitions moved
+	for _, id := range stale {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := ch.DropPartitionID(db, table, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
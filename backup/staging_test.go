@@ -0,0 +1,35 @@
+package backup
+
+import (
+	"cliback/config"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRestoredPartitionIDs(t *testing.T) {
+	ti := tableInfo{Files: map[string]fileInfo{
+		"202105_1_1_0/data.bin":    {},
+		"202105_2_2_0/data.bin":    {},
+		"202104_3_3_0/data.bin":    {},
+		"202104_3_3_0/columns.txt": {},
+	}}
+	if ids := restoredPartitionIDs(&ti); !reflect.DeepEqual(ids, []string{"202104", "202105"}) {
+		t.Errorf("bad ids: %v", ids)
+	}
+	if ids := restoredPartitionIDs(&tableInfo{}); len(ids) != 0 {
+		t.Errorf("bad ids for empty table: %v", ids)
+	}
+}
+
+func TestMoveStagedCancelled(t *testing.T) {
+	c := config.New()
+	defer func(opts config.ChMetaOpts) { c.ClickhouseRestoreOpts = opts }(c.ClickhouseRestoreOpts)
+	c.ClickhouseRestoreOpts.OnConflict = ConflictAppend
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// cancelled before first partition, no server queries
+	if err := moveStaged(ctx, "db", "t", stagingName("t"), "MergeTree", []string{"202105"}); err != context.Canceled {
+		t.Errorf("moveStaged cancelled: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"cliback/config"
+	"cliback/status"
+	"cliback/transport"
+	"cliback/workerpool"
+	"context"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tableJob files of one table in shared file pool
+type tableJob struct {
+	db    string
+	table string
+	ti    tableInfo
+	mux   sync.Mutex
+	wg    sync.WaitGroup
+}
+
+// fileJob file in shared file pool
+type fileJob struct {
+	cf    transport.CliFile
+	table *tableJob
+}
+
+// done file result after all retries
+func (tj *tableJob) done(ctx context.Context, cf transport.CliFile, err error) {
+	defer tj.wg.Done()
+	addFileResult(tj.db, tj.table, cf, err)
+	if err != nil && ctx.Err() == nil {
+		s := status.New()
+		if cf.RunJobType == transport.Backup {
+			s.SetStatus(status.FailBackupFile)
+		} else {
+			s.SetStatus(status.FailRestoreFile)
+		}
+	}
+	if cf.RunJobType != transport.Backup || (err != nil && ctx.Err() != nil) {
+		// aborted file is not backuped, not add it to table info
+		return
+	}
+	tj.mux.Lock()
+	tj.ti.AddJob(&cf)
+	tj.mux.Unlock()
+}
+
+// retryable missing files, permissions and cancel are not retried
+func retryable(err error) bool {
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return false
+	}
+	return workerpool.DefaultRetryable(err)
+}
+
+// filesPool shared file pool for all tables, results sent to tables of jobs
+func filesPool(ctx context.Context, run func(fj *fileJob) (transport.CliFile, error)) *workerpool.WorkerPool {
+	c := config.New()
+	var wpTask workerpool.TaskFunc = func(i interface{}) (interface{}, error) {
+		fj, _ := i.(*fileJob)
+		return run(fj)
+	}
+	wp := workerpool.MakeWorkerPool(ctx, wpTask, c.WorkerPool.NumWorkers, c.WorkerPool.NumRetry, c.WorkerPool.ChanLen)
+	wp.SetBackoff(time.Duration(c.WorkerPool.RetryDelay)*time.Second, time.Duration(c.WorkerPool.RetryMaxDelay)*time.Second)
+	wp.SetRetryable(retryable)
+	wp.Start()
+	go func() {
+		for res := range wp.GetResultsChan() {
+			fj, _ := res.Job.(*fileJob)
+			cf, ok := res.Value.(transport.CliFile)
+			if !ok {
+				cf = fj.cf
+			}
+			cf.Retries = res.Retries
+			fj.table.done(ctx, cf, res.Err)
+		}
+	}()
+	return wp
+}
+
+// backupFilesPool shared file pool for all tables of backup
+func backupFilesPool(ctx context.Context) *workerpool.WorkerPool {
+	return filesPool(ctx, func(fj *fileJob) (transport.CliFile, error) {
+		return BackupRun(ctx, fj.cf, fj.table.db, fj.table.table)
+	})
+}
+
+// backupTables backup num_tables tables at once, backup info written after each database
+func backupTables(ctx context.Context, bi *backupInfo, backupObjects map[string][]string) {
+	c := config.New()
+	numTables := c.WorkerPool.NumTables
+	if numTables < 1 {
+		numTables = 1
+	}
+	wp := backupFilesPool(ctx)
+	budget := newShadowBudget(ctx, backupObjects)
+	var (
+		mux    sync.Mutex
+		wg     sync.WaitGroup
+		tables = make(chan struct{}, numTables)
+		dbLeft = map[string]int{}
+	)
+	for db, dbTables := range backupObjects {
+		dbLeft[db] = len(dbTables)
+		bi.DBS[db] = databaseInfo{
+			Tables:   map[string]tableInfo{},
+			MetaData: map[string]fileInfo{},
+		}
+	}
+	for db, dbTables := range backupObjects {
+		for _, table := range dbTables {
+			select {
+			case tables <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			go func(db, table string) {
+				defer wg.Done()
+				defer func() { <-tables }()
+				log.Printf("Backup table: `%s`.`%s`", db, table)
+				ti, err := backupTable(ctx, wp.GetJobsChan(), budget, db, table)
+				err = addTableResult(db, table, err)
+				if err != nil {
+					log.Printf("Backup table `%s`.`%s` error: %v", db, table, err)
+					ti.Error = err.Error()
+				}
+				mux.Lock()
+				defer mux.Unlock()
+				di := bi.DBS[db]
+				di.Tables[table] = ti
+				// Added for backward compatibility
+				di.MetaData[table] = ti.MetaData
+				di.Add(&ti)
+				bi.DBS[db] = di
+				dbLeft[db]--
+				if dbLeft[db] > 0 {
+					return
+				}
+				bi.Add(&di)
+				bi.StopDate = GetFormatedTime()
+				if ctx.Err() != nil {
+					return
+				}
+				if err := BackupInfoWrite(ctx, bi); err != nil {
+					log.Printf("Write backup info error: %v", err)
+				}
+			}(db, table)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	wg.Wait()
+	close(wp.GetJobsChan())
+}
+
+// restoreItem table from backup for restore
+type restoreItem struct {
+	db    string
+	table string
+}
+
+func (ri restoreItem) String() string {
+	return ri.db + "." + ri.table
+}
+
+// restoreOrder split tables into phases: priority tables in order of patterns, then others by name
+func restoreOrder(tables []restoreItem, priority []string) [][]restoreItem {
+	rank := func(ri restoreItem) int {
+		for i, p := range priority {
+			if ok, _ := path.Match(p, ri.String()); ok {
+				return i
+			}
+		}
+		return len(priority)
+	}
+	sort.SliceStable(tables, func(i, j int) bool {
+		ri, rj := rank(tables[i]), rank(tables[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return tables[i].String() < tables[j].String()
+	})
+	var first, rest []restoreItem
+	for _, t := range tables {
+		if rank(t) < len(priority) {
+			first = append(first, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+	var phases [][]restoreItem
+	for _, phase := range [][]restoreItem{first, rest} {
+		if len(phase) > 0 {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
+
+// restoreFilesPool shared file pool for all tables of restore
+func restoreFilesPool(ctx context.Context) *workerpool.WorkerPool {
+	return filesPool(ctx, func(fj *fileJob) (transport.CliFile, error) {
+		return RestoreRun(ctx, fj.cf)
+	})
+}
+
+// restoreTables restore num_tables tables at once, priority tables restored and attached before others
+func restoreTables(ctx context.Context, bi *backupInfo, tables []restoreItem) error {
+	c := config.New()
+	numTables := c.WorkerPool.NumTables
+	if numTables < 1 {
+		numTables = 1
+	}
+	wp := restoreFilesPool(ctx)
+	defer close(wp.GetJobsChan())
+	for i, phase := range restoreOrder(tables, c.RestorePriority) {
+		if len(c.RestorePriority) > 0 && i == 0 {
+			log.Printf("Restore priority tables: %v", phase)
+		}
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, numTables)
+		for _, ri := range phase {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			go func(ri restoreItem) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				log.Printf("Restore table: `%s`.`%s`", ri.db, ri.table)
+				if err := restoreOneTable(ctx, wp.GetJobsChan(), bi, ri.db, ri.table); err != nil {
+					log.Printf("Restore table `%s`.`%s` error: %v", ri.db, ri.table, err)
+				}
+			}(ri)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
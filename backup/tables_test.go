@@ -0,0 +1,26 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRestoreOrder(t *testing.T) {
+	tables := []restoreItem{
+		{"logs", "history"},
+		{"billing", "payments"},
+		{"app", "users"},
+		{"billing", "orders"},
+		{"app", "sessions"},
+	}
+	phases := restoreOrder(tables, []string{"billing.orders", "billing.*", "app.users"})
+	got := fmt.Sprint(phases)
+	expect := "[[billing.orders billing.payments app.users] [app.sessions logs.history]]"
+	if got != expect {
+		t.Errorf("restoreOrder = %s, expect %s", got, expect)
+	}
+	phases = restoreOrder(tables, nil)
+	if len(phases) != 1 || len(phases[0]) != len(tables) {
+		t.Errorf("without priority expect one phase, got %v", phases)
+	}
+}
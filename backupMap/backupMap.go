@@ -88,6 +88,27 @@ func (bm *backupMap) GetFullsForDelete(maxFullBacks int) []string {
 	return fulls[0 : lenFulls-maxFullBacks]
 }
 
+// GetSchemas schema only backups, standalone without deps
+func (bm *backupMap) GetSchemas() []string {
+	var schemas []string
+	for _, b := range bm.backupsExists {
+		if metaDirNameMatched(b, "S") {
+			schemas = append(schemas, b)
+		}
+	}
+	return schemas
+}
+
+// GetSchemasForDelete schema backups over maxBacks, oldest first
+func (bm *backupMap) GetSchemasForDelete(maxBacks int) []string {
+	schemas := bm.GetSchemas()
+	if len(schemas) <= maxBacks {
+		return []string{}
+	}
+	sort.Strings(schemas)
+	return schemas[0 : len(schemas)-maxBacks]
+}
+
 func (bm *backupMap) GetFullsForStore(maxFullBacks int) []string {
 	fulls := bm.GetFulls()
 	lenFulls := len(fulls)
@@ -104,7 +125,7 @@ func (bm *backupMap) GetBackupsForDelete(maxFullBacks int) []string {
 		backups = append(backups, b)
 		backups = append(backups, bm.depsForward[b]...)
 	}
-	return backups
+	return append(backups, bm.GetSchemasForDelete(maxFullBacks)...)
 }
 
 func (bm *backupMap) GetBackupsForStore(maxFullBacks int) []string {
@@ -134,7 +155,7 @@ func isFullBackup(name string) bool {
 }
 
 func metaDirNameMatched(metaDirName string, types ...string) bool {
-	backupType := "FDIP"
+	backupType := "FDIPS"
 	if len(types) > 0 {
 		backupType = types[0]
 	}
@@ -24,3 +24,17 @@ func TestRetensionBackupMap(t *testing.T) {
 	fmt.Println("Backups for Delete:", bm.GetBackupsForDelete(2))
 	fmt.Println("Finish")
 }
+
+func TestRetentionSchemaBackups(t *testing.T) {
+	bm := &backupMap{depsForward: map[string][]string{}, depsBackward: map[string][]string{}}
+	for _, b := range []string{"20200101_000000S", "20200102_000000S", "20200103_000000S", "20200101_000000F", "20200102_000000F"} {
+		bm.Add(b)
+	}
+	if fulls := bm.GetFulls(); len(fulls) != 2 {
+		t.Errorf("schema backups counted as full: %v", fulls)
+	}
+	del := bm.GetBackupsForDelete(2)
+	if len(del) != 1 || del[0] != "20200101_000000S" {
+		t.Errorf("bad backups for delete: %v", del)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"path"
-	"strconv"
+	"strings"
 	"sync"
 
 	"gopkg.in/yaml.v2"
@@ -25,6 +25,21 @@ type backupStorage struct {
 	Type       string     `yaml:"type"`
 	BackupDir  string     `yaml:"backup_dir"`
 	BackupConn Connection `yaml:"backup_conn"`
+	RateLimit  int64      `yaml:"rate_limit,omitempty"` // bytes/sec
+}
+
+// ThrottleT disk IO limits in bytes/sec, shared by all workers
+type ThrottleT struct {
+	ReadBytesPerSec  int64 `yaml:"read_bytes_per_sec,omitempty"`
+	WriteBytesPerSec int64 `yaml:"write_bytes_per_sec,omitempty"`
+}
+
+// ObjectDisk connection for Clickhouse s3 disk, endpoint same as in disk config
+type ObjectDisk struct {
+	Endpoint        string `yaml:"endpoint"`
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+	Region          string `yaml:"region,omitempty"`
 }
 
 type RunJobType int
@@ -33,6 +48,7 @@ const (
 	Backup RunJobType = iota + 1
 	Restore
 	Info
+	Cleanup
 )
 
 type taskArgs struct {
@@ -40,35 +56,82 @@ type taskArgs struct {
 	JobName      string
 	JobPartition string
 	BackupType   string
+	DataOnly     bool
 	Debug        bool
-	DBNow        string
-	TableNow     string
+	ShardDir     string
+	Version      string
+}
+
+// DDLRewriteRule changes table meta on restore, database and table are glob patterns
+type DDLRewriteRule struct {
+	Database       string            `yaml:"database,omitempty"`
+	Table          string            `yaml:"table,omitempty"`
+	NewDatabase    string            `yaml:"new_database,omitempty"`
+	NewTable       string            `yaml:"new_table,omitempty"`
+	Engine         string            `yaml:"engine,omitempty"`
+	ZooKeeperPath  string            `yaml:"zookeeper_path,omitempty"`
+	ReplicaName    string            `yaml:"replica_name,omitempty"`
+	StoragePolicy  string            `yaml:"storage_policy,omitempty"`
+	Settings       map[string]string `yaml:"settings,omitempty"`
+	RemoveSettings []string          `yaml:"remove_settings,omitempty"`
+}
+
+// PartitionRule partition selector for tables of part backup, database and table are glob patterns
+type PartitionRule struct {
+	Database   string `yaml:"database,omitempty"`
+	Table      string `yaml:"table,omitempty"`
+	Partitions string `yaml:"partitions"`
 }
 
 type ChMetaOpts struct {
-	CutReplicated          bool `yaml:"replace_replicated_to_default"`
-	BadStorageToDefault    bool `yaml:"move_bad_storage_to_default"`
-	FailIfStorageNotExists bool `yaml:"fail_if_storage_not_exists"`
+	CutReplicated          bool              `yaml:"replace_replicated_to_default"`
+	BadStorageToDefault    bool              `yaml:"move_bad_storage_to_default"`
+	FailIfStorageNotExists bool              `yaml:"fail_if_storage_not_exists"`
+	ServerCheck            string            `yaml:"server_check,omitempty"`
+	DiskMap                map[string]string `yaml:"disk_map,omitempty"`
+	ReplicatedZkPath       string            `yaml:"replicated_zookeeper_path,omitempty"`
+	ReplicatedReplicaName  string            `yaml:"replicated_replica_name,omitempty"`
+	DDLRewrite             []DDLRewriteRule  `yaml:"ddl_rewrite,omitempty"`
+	OnConflict             string            `yaml:"on_conflict,omitempty"`
+	StagingRestore         bool              `yaml:"staging_restore,omitempty"`
 }
 
 type WorkerPoolT struct {
-	NumWorkers int `yaml:"num_workers"`
-	NumRetry   int `yaml:"num_retry"`
-	ChanLen    int `yaml:"chan_len"`
+	NumWorkers    int `yaml:"num_workers"`
+	NumRetry      int `yaml:"num_retry"`
+	ChanLen       int `yaml:"chan_len"`
+	NumTables     int `yaml:"num_tables,omitempty"`
+	RetryDelay    int `yaml:"retry_delay_sec,omitempty"`
+	RetryMaxDelay int `yaml:"retry_max_delay_sec,omitempty"`
 }
 
 type config struct {
-	BackupStorage         backupStorage       `yaml:"backup_storage"`
-	ShadowDirIncr         int                 `yaml:"-"`
-	TaskArgs              taskArgs            `yaml:"-"`
-	ClickhouseBackupConn  Connection          `yaml:"clickhouse_backup_conn"`
-	ClickhouseRestoreConn Connection          `yaml:"clickhouse_restore_conn"`
-	ClickhouseRestoreOpts ChMetaOpts          `yaml:"clickhouse_restore_opts"`
-	ClickhouseStorage     map[string]string   `yaml:"clickhouse_storage"`
-	BackupFilter          map[string][]string `yaml:"backup_filter"`
-	RestoreFilter         map[string][]string `yaml:"restore_filter"`
-	WorkerPool            WorkerPoolT         `yaml:"worker_pool"`
-	RetentionBackupFull   int                 `yaml:"retention_backup_full"`
+	BackupStorage         backupStorage         `yaml:"backup_storage"`
+	TaskArgs              taskArgs              `yaml:"-"`
+	ClickhouseBackupConn  Connection            `yaml:"clickhouse_backup_conn"`
+	ClickhouseRestoreConn Connection            `yaml:"clickhouse_restore_conn"`
+	ClickhouseRestoreOpts ChMetaOpts            `yaml:"clickhouse_restore_opts"`
+	ClickhouseStorage     map[string]string     `yaml:"clickhouse_storage"`
+	ClickhouseDiskTypes   map[string]string     `yaml:"-"`
+	ObjectDisks           map[string]ObjectDisk `yaml:"object_disks,omitempty"`
+	BackupFilter          map[string][]string   `yaml:"backup_filter"`
+	RestoreFilter         map[string][]string   `yaml:"restore_filter"`
+	BackupExclude         []string              `yaml:"backup_exclude,omitempty"`
+	RestoreExclude        []string              `yaml:"restore_exclude,omitempty"`
+	RestorePriority       []string              `yaml:"restore_priority,omitempty"`
+	PartitionFilter       []PartitionRule       `yaml:"partition_filter,omitempty"`
+	RestorePartitions     []PartitionRule       `yaml:"restore_partitions,omitempty"`
+	WorkerPool            WorkerPoolT           `yaml:"worker_pool"`
+	Throttle              ThrottleT             `yaml:"throttle,omitempty"`
+	RetentionBackupFull   int                   `yaml:"retention_backup_full"`
+	ClusterName           string                `yaml:"cluster_name,omitempty"`
+	SkipFreeSpaceCheck    bool                  `yaml:"skip_free_space_check,omitempty"`
+	RehashFiles           bool                  `yaml:"rehash_files,omitempty"`
+	IncrementalStrategy   string                `yaml:"incremental_strategy,omitempty"`
+	SkipStartupCleanup    bool                  `yaml:"skip_startup_cleanup,omitempty"`
+	CleanupMinAge         int                   `yaml:"cleanup_min_age_hours,omitempty"`
+	StateDir              string                `yaml:"state_dir,omitempty"`
+	ReportFile            string                `yaml:"report_file,omitempty"`
 }
 
 var (
@@ -101,6 +164,33 @@ func (c *config) Print() {
 	fmt.Println(c)
 }
 
-func (c *config) GetShadow(storageName string) string {
-	return path.Join(c.ClickhouseStorage[storageName], "shadow", strconv.Itoa(c.ShadowDirIncr))
+// IsObjectDisk tells whether Clickhouse disk keeps data in object storage
+func (c *config) IsObjectDisk(storageName string) bool {
+	switch c.ClickhouseDiskTypes[storageName] {
+	case "s3", "s3_plain", "azure_blob_storage", "hdfs", "web":
+		return true
+	}
+	return false
+}
+
+// ParsePartitionRules parse db.table:selector rules separated by ';'
+func ParsePartitionRules(s string) ([]PartitionRule, error) {
+	var rules []PartitionRule
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if len(item) < 1 {
+			continue
+		}
+		kv := strings.SplitN(item, ":", 2)
+		dbTable := strings.SplitN(kv[0], ".", 2)
+		if len(kv) != 2 || len(dbTable) != 2 || len(kv[1]) < 1 {
+			return nil, fmt.Errorf("Bad partition rule `%s`, use db.table:selector", item)
+		}
+		rules = append(rules, PartitionRule{Database: dbTable[0], Table: dbTable[1], Partitions: kv[1]})
+	}
+	return rules, nil
+}
+
+func (c *config) GetShadow(storageName, shadowName string) string {
+	return path.Join(c.ClickhouseStorage[storageName], "shadow", shadowName)
 }
@@ -2,6 +2,8 @@ package database
 
 import (
 	"cliback/config"
+	"cliback/workerpool"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -24,7 +26,10 @@ var (
 )
 
 type ChMetaOpts struct {
-	cutReplicated bool
+	cutReplicated     bool
+	replicatedZkPath  string
+	replicatedReplica string
+	rewriteRules      []config.DDLRewriteRule
 }
 type ChDb struct {
 	dsn       string
@@ -32,6 +37,9 @@ type ChDb struct {
 	reconnect bool
 	mux       sync.Mutex
 	metaOpts  ChMetaOpts
+	macros    map[string]string
+	macrosMux sync.Mutex
+	ctx       context.Context
 }
 
 type TableInfo struct {
@@ -45,6 +53,7 @@ type TableInfo struct {
 	TableEngine    string
 	DatabaseUUID   string
 	TableUUID      string
+	StoragePolicy  string
 }
 
 func (ti *TableInfo) GetShortPath() string {
@@ -133,6 +142,12 @@ func (ch *ChDb) SetDSN(dsn config.Connection) {
 }
 func (ch *ChDb) SetMetaOpts(cm config.ChMetaOpts) {
 	ch.metaOpts.cutReplicated = cm.CutReplicated
+	ch.metaOpts.replicatedZkPath = cm.ReplicatedZkPath
+	ch.metaOpts.replicatedReplica = cm.ReplicatedReplicaName
+	if len(ch.metaOpts.replicatedReplica) < 1 {
+		ch.metaOpts.replicatedReplica = "{replica}"
+	}
+	ch.metaOpts.rewriteRules = cm.DDLRewrite
 }
 
 func (ch *ChDb) Close() error {
@@ -177,16 +192,27 @@ func (ch *ChDb) ReConnect() error {
 	return nil
 }
 
+// SetContext set job context, waiting for reconnect stopped on its cancel
+func (ch *ChDb) SetContext(ctx context.Context) {
+	ch.ctx = ctx
+}
+
+func (ch *ChDb) context() context.Context {
+	if ch.ctx == nil {
+		return context.Background()
+	}
+	return ch.ctx
+}
+
+// ReConnectLoop reconnect with worker_pool retry options
 func (ch *ChDb) ReConnectLoop() error {
-	for {
+	return workerpool.Retry(ch.context(), func() error {
 		err := ch.ReConnect()
 		if err != nil {
-			log.Printf("Error connect to Clickhouse: %s. Sleep 5s", err)
-			time.Sleep(time.Second * 5)
-			continue
+			return fmt.Errorf("Error connect to Clickhouse: %w", err)
 		}
 		return nil
-	}
+	})
 }
 
 func (ch *ChDb) Execute(q string) (sql.Result, error) {
@@ -198,6 +224,19 @@ func (ch *ChDb) Execute(q string) (sql.Result, error) {
 	}
 	return ch.connect.Exec(q)
 }
+
+// IsUnsupported tells whether server rejected query as syntax error or not
+// implemented feature, e.g. FREEZE WITH NAME on old servers
+func IsUnsupported(err error) bool {
+	if exception, ok := err.(*clickhouse.Exception); ok {
+		switch exception.Code {
+		case 1, 48, 62: // UNSUPPORTED_METHOD, NOT_IMPLEMENTED, SYNTAX_ERROR
+			return true
+		}
+	}
+	return false
+}
+
 func (ch *ChDb) Query(q string) (*sql.Rows, error) {
 	ch.mux.Lock()
 	defer ch.mux.Unlock()
@@ -244,6 +283,47 @@ func (ch *ChDb) GetTables(db string) ([]string, error) {
 	}
 	return result, nil
 }
+
+// GetAllTables returns all tables, views and dictionaries of database, with or without data
+func (ch *ChDb) GetAllTables(db string) ([]string, error) {
+	var result []string
+	rows, err := ch.Query(fmt.Sprintf("SELECT name FROM system.tables WHERE database = %s AND NOT is_temporary", QuoteString(db)))
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err == nil {
+			result = append(result, table)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return []string{}, err
+	}
+	return result, nil
+}
+
+// GetAllDBS returns all databases, system databases skipped
+func (ch *ChDb) GetAllDBS() ([]string, error) {
+	var result []string
+	rows, err := ch.Query("SELECT name FROM system.databases WHERE name NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema')")
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var db string
+		if err := rows.Scan(&db); err == nil {
+			result = append(result, db)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return []string{}, err
+	}
+	return result, nil
+}
+
 func (ch *ChDb) GetPartitions(db, table, part string) ([]string, error) {
 	var result []string
 	var query string
@@ -323,6 +403,7 @@ func (ch *ChDb) GetTableInfo(db, table string) (TableInfo, error) {
 	result.TableUUID = GetStringFromMapInterface(tbRes, "uuid")
 	result.TableEngine = GetStringFromMapInterface(tbRes, "engine")
 	result.TablePaths = GetStringsFromMapInterface(tbRes, "data_paths")
+	result.StoragePolicy = GetStringFromMapInterface(tbRes, "storage_policy")
 	return result, nil
 }
 
@@ -345,6 +426,290 @@ func (ch *ChDb) GetDisks() (map[string]string, error) {
 	}
 	return result, nil
 }
+
+type ClusterReplica struct {
+	ShardNum    uint32
+	ReplicaNum  uint32
+	HostName    string
+	HostAddress string
+	Port        uint16
+	IsLocal     bool
+}
+
+func (ch *ChDb) GetClusterReplicas(cluster string) ([]ClusterReplica, error) {
+	var result []ClusterReplica
+	query := fmt.Sprintf("SELECT shard_num,replica_num,host_name,host_address,port,is_local FROM system.clusters WHERE cluster = '%s' ORDER BY shard_num,replica_num", cluster)
+	rows, err := ch.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r ClusterReplica
+		var isLocal uint8
+		if err := rows.Scan(&r.ShardNum, &r.ReplicaNum, &r.HostName, &r.HostAddress, &r.Port, &isLocal); err == nil {
+			r.IsLocal = isLocal == 1
+			result = append(result, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(result) < 1 {
+		return nil, fmt.Errorf("Cluster %s not found in system.clusters", cluster)
+	}
+	return result, nil
+}
+
+// Ping check Clickhouse connection without touching shared instance
+func Ping(dsn config.Connection) error {
+	ch := new(ChDb)
+	ch.SetDSN(dsn)
+	defer ch.Close()
+	return ch.ReConnect()
+}
+
+// GetMacros returns system.macros loaded once, safe for parallel restore of tables.
+// Returned map must not be changed
+func (ch *ChDb) GetMacros() (map[string]string, error) {
+	ch.macrosMux.Lock()
+	defer ch.macrosMux.Unlock()
+	if ch.macros != nil {
+		return ch.macros, nil
+	}
+	result := map[string]string{}
+	rows, err := ch.Query("SELECT macro,substitution FROM system.macros")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var macro, substitution string
+		if err := rows.Scan(&macro, &substitution); err == nil {
+			result[macro] = substitution
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	ch.macros = result
+	return result, nil
+}
+
+// ExpandMacros replace {macro} in template, error if macro unknown
+func ExpandMacros(template string, macros map[string]string) (string, error) {
+	re := regexp.MustCompile("{([^{}]+)}")
+	var err error
+	result := re.ReplaceAllStringFunc(template, func(m string) string {
+		name := m[1 : len(m)-1]
+		if v, ok := macros[name]; ok {
+			return v
+		}
+		err = fmt.Errorf("Macro %s not exists in system.macros", m)
+		return m
+	})
+	return result, err
+}
+
+type ServerInfo struct {
+	HostName string
+	Version  string
+	Timezone string
+}
+
+func (ch *ChDb) GetServerInfo() (ServerInfo, error) {
+	var result ServerInfo
+	rows, err := ch.Query("SELECT hostName(),version(),timezone()")
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.Scan(&result.HostName, &result.Version, &result.Timezone); err != nil {
+			return result, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// GetStoragePolicies returns policy -> volume -> disks
+func (ch *ChDb) GetStoragePolicies() (map[string]map[string][]string, error) {
+	result := map[string]map[string][]string{}
+	rows, err := ch.Query("SELECT policy_name,volume_name,disks FROM system.storage_policies")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var policy, volume string
+		var disks []string
+		if err := rows.Scan(&policy, &volume, &disks); err == nil {
+			if _, ok := result[policy]; !ok {
+				result[policy] = map[string][]string{}
+			}
+			result[policy][volume] = disks
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetPoliciesVolumes returns policy -> disks of policy volumes ordered by volume priority
+func (ch *ChDb) GetPoliciesVolumes() (map[string][][]string, error) {
+	result := map[string][][]string{}
+	rows, err := ch.Query("SELECT policy_name,disks FROM system.storage_policies ORDER BY policy_name,volume_priority")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var policy string
+		var disks []string
+		if err := rows.Scan(&policy, &disks); err == nil {
+			result[policy] = append(result[policy], disks)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetDisksFreeSpace returns disk name -> free space in bytes
+func (ch *ChDb) GetDisksFreeSpace() (map[string]int64, error) {
+	result := map[string]int64{}
+	rows, err := ch.Query("SELECT name,free_space FROM system.disks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var disk string
+		var free uint64
+		if err := rows.Scan(&disk, &free); err == nil {
+			result[disk] = int64(free)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type PartsSize struct {
+	DBName    string
+	TableName string
+	Disk      string
+	Bytes     int64
+}
+
+// GetPartsSize returns bytes on disk of active parts by table and disk
+func (ch *ChDb) GetPartsSize() ([]PartsSize, error) {
+	var result []PartsSize
+	rows, err := ch.Query("SELECT database,table,disk_name,sum(bytes_on_disk) FROM system.parts WHERE active GROUP BY database,table,disk_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ps PartsSize
+		var size uint64
+		if err := rows.Scan(&ps.DBName, &ps.TableName, &ps.Disk, &size); err == nil {
+			ps.Bytes = int64(size)
+			result = append(result, ps)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PartitionInfo active partition of table with last modification of its parts
+type PartitionInfo struct {
+	Partition        string
+	ID               string
+	ModificationTime time.Time
+}
+
+// GetPartitionInfos returns active partitions of table
+func (ch *ChDb) GetPartitionInfos(db, table string) ([]PartitionInfo, error) {
+	var result []PartitionInfo
+	query := fmt.Sprintf("SELECT partition,partition_id,toInt64(toUnixTimestamp(max(modification_time))) FROM system.parts WHERE active AND database = %s AND table = %s GROUP BY partition,partition_id",
+		QuoteString(db), QuoteString(table))
+	rows, err := ch.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pi PartitionInfo
+		var mtime int64
+		if err := rows.Scan(&pi.Partition, &pi.ID, &mtime); err == nil {
+			pi.ModificationTime = time.Unix(mtime, 0)
+			result = append(result, pi)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PartInfo active part of table for part level incremental backup
+type PartInfo struct {
+	Name             string
+	Hash             string
+	ModificationTime string
+}
+
+// GetParts returns active parts of table with hash of all files
+func (ch *ChDb) GetParts(db, table string) ([]PartInfo, error) {
+	var result []PartInfo
+	query := fmt.Sprintf("SELECT name,hash_of_all_files,toString(modification_time) FROM system.parts WHERE active AND database = %s AND table = %s",
+		QuoteString(db), QuoteString(table))
+	rows, err := ch.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pi PartInfo
+		if err := rows.Scan(&pi.Name, &pi.Hash, &pi.ModificationTime); err == nil {
+			result = append(result, pi)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetDiskTypes returns disk name -> type (local, s3, ...)
+func (ch *ChDb) GetDiskTypes() (map[string]string, error) {
+	result := map[string]string{}
+	rows, err := ch.Query("SELECT name,type FROM system.disks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var disk, diskType string
+		if err := rows.Scan(&disk, &diskType); err == nil {
+			result[disk] = diskType
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (ch *ChDb) GetDBProps(dbName string) (map[string]string, error) {
 	result := map[string]string{}
 	query := fmt.Sprintf("SELECT name,engine,data_path,metadata_path,uuid FROM system.databases WHERE name='%s'", dbName)
@@ -375,6 +740,11 @@ func (ch *ChDb) GetDBProps(dbName string) (map[string]string, error) {
 	return result, nil
 }
 func (ch *ChDb) FreezeTable(db, table, part string) error {
+	return ch.FreezeTableWithName(db, table, part, "")
+}
+
+// FreezeTableWithName freeze table into shadow/<name>, plain freeze if name is empty
+func (ch *ChDb) FreezeTableWithName(db, table, part, name string) error {
 	var query string
 	if part == "" {
 		query = fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE", db, table)
@@ -383,9 +753,28 @@ func (ch *ChDb) FreezeTable(db, table, part string) error {
 	} else {
 		query = fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE PARTITION '%s'", db, table, part)
 	}
+	if len(name) > 0 {
+		query += fmt.Sprintf(" WITH NAME '%s'", name)
+	}
+	_, err := ch.Execute(query)
+	return err
+}
+
+// FreezePartitionID freeze partition by partition_id into shadow/<name>, plain freeze if name is empty
+func (ch *ChDb) FreezePartitionID(db, table, id, name string) error {
+	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` FREEZE PARTITION ID %s", db, table, QuoteString(id))
+	if len(name) > 0 {
+		query += fmt.Sprintf(" WITH NAME '%s'", name)
+	}
 	_, err := ch.Execute(query)
 	return err
 }
+
+// UnfreezeByName remove shadow/<name> on all disks
+func (ch *ChDb) UnfreezeByName(name string) error {
+	_, err := ch.Execute(fmt.Sprintf("SYSTEM UNFREEZE WITH NAME '%s'", name))
+	return err
+}
 func (ch *ChDb) GetIncrement() (int, error) {
 	c := config.New()
 	b, err := ioutil.ReadFile(path.Join(c.ClickhouseStorage["default"], "shadow/increment.txt"))
@@ -416,42 +805,254 @@ func (ch *ChDb) CreateDatabase(db string) error {
 	_, err := ch.Execute(query)
 	return err
 }
+
+// DropTable drop table synchronously
+func (ch *ChDb) DropTable(db, table string) error {
+	log.Printf("Drop table `%s`.`%s`", db, table)
+	_, err := ch.Execute(fmt.Sprintf("DROP TABLE IF EXISTS `%s`.`%s` SYNC", db, table))
+	return err
+}
+
+// TableExists tells whether table exists
+func (ch *ChDb) TableExists(db, table string) (bool, error) {
+	rows, err := ch.Query(fmt.Sprintf("SELECT count() FROM system.tables WHERE database = %s AND name = %s", QuoteString(db), QuoteString(table)))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var count uint64
+	for rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return false, err
+		}
+	}
+	return count > 0, rows.Err()
+}
+
+// CreateStagingTable create restored table meta as staging table in target database,
+// without UUID and replication
+func (ch *ChDb) CreateStagingTable(db, table, meta, staging string) error {
+	meta, err := ch.RewriteDDL(db, table, meta)
+	if err != nil {
+		return err
+	}
+	ddl, err := ParseDDL(meta)
+	if err != nil {
+		return err
+	}
+	rdb, _ := ch.RestoreName(db, table)
+	if err := ddl.SetName(rdb, staging); err != nil {
+		return err
+	}
+	if err := ddl.RemoveUUID(); err != nil {
+		return err
+	}
+	if IsReplicatedEngine(ddl.Engine()) {
+		if err := ddl.CutReplicated(); err != nil {
+			return err
+		}
+	}
+	log.Printf("Create staging table:\n%s", ddl.String())
+	_, err = ch.Execute(ddl.String())
+	return err
+}
+
+// MovePartitionFrom attach (or replace) partition by partition_id from other table of database
+func (ch *ChDb) MovePartitionFrom(db, table, id, from string, replace bool) error {
+	verb := "ATTACH"
+	if replace {
+		verb = "REPLACE"
+	}
+	log.Printf("%s partition `%s`.`%s` id %s from `%s`", verb, db, table, id, from)
+	_, err := ch.Execute(fmt.Sprintf("ALTER TABLE `%s`.`%s` %s PARTITION ID %s FROM `%s`.`%s`", db, table, verb, QuoteString(id), db, from))
+	return err
+}
+
+// ExchangeTables swap tables atomically, Atomic database required
+func (ch *ChDb) ExchangeTables(db, a, b string) error {
+	log.Printf("Exchange tables `%s`.`%s` and `%s`.`%s`", db, a, db, b)
+	_, err := ch.Execute(fmt.Sprintf("EXCHANGE TABLES `%s`.`%s` AND `%s`.`%s`", db, a, db, b))
+	return err
+}
+
+// DropPartitionID drop partition by partition_id
+func (ch *ChDb) DropPartitionID(db, table, id string) error {
+	log.Printf("Drop partition `%s`.`%s` id %s", db, table, id)
+	_, err := ch.Execute(fmt.Sprintf("ALTER TABLE `%s`.`%s` DROP PARTITION ID %s", db, table, QuoteString(id)))
+	return err
+}
+
 func ReplaceAttachToCreateTable(db, table, meta string) string {
-	meta = strings.Replace(meta, "CREATE TABLE ", "CREATE TABLE IF NOT EXISTS ", 1)
-	meta = strings.Replace(meta, fmt.Sprintf("ATTACH TABLE %s", table), fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s`", db, table), 1)
-	meta = strings.Replace(meta, fmt.Sprintf("ATTACH TABLE `%s`", table), fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s`", db, table), 1)
-	return meta
+	ddl, err := ParseDDL(meta)
+	if err != nil {
+		log.Printf("Parse DDL `%s`.`%s` error: %v", db, table, err)
+		return meta
+	}
+	if err := ddl.SetCreate(true); err != nil {
+		return meta
+	}
+	if err := ddl.SetName(db, table); err != nil {
+		return meta
+	}
+	return ddl.String()
 }
 func ReplaceCutReplicatedTable(meta string) string {
-	re := regexp.MustCompile("ENGINE\\s=\\sReplicated\\w*MergeTree")
-	if !re.MatchString(meta) {
+	ddl, err := ParseDDL(meta)
+	if err != nil {
 		return meta
 	}
-	engineLabelPos := re.FindStringIndex(meta)
-	endStrings := []string{"PARTITION BY", "ORDER BY", "SETTINGS", "PRIMARY KEY", "SAMPLE BY", "TTL"}
-	endPos := -1
-	for _, es := range endStrings {
-		ep := strings.Index(meta, es)
-		if ep >= 0 {
-			if endPos == -1 || ep < endPos {
-				endPos = ep
-			}
+	if err := ddl.CutReplicated(); err != nil {
+		return meta
+	}
+	return ddl.String()
+}
+
+func ruleMatched(rule config.DDLRewriteRule, db, table string) bool {
+	if len(rule.Database) > 0 {
+		if ok, _ := path.Match(rule.Database, db); !ok {
+			return false
 		}
 	}
-	if endPos < 0 {
-		args := strings.Split(meta[engineLabelPos[1]:], ", ")
-		argsStr := "(" + strings.Join(args[2:], ",")
-		return meta[:engineLabelPos[0]] + "ENGINE = MergeTree" + argsStr
+	if len(rule.Table) > 0 {
+		if ok, _ := path.Match(rule.Table, table); !ok {
+			return false
+		}
 	}
-	return meta[:engineLabelPos[0]] + "ENGINE = MergeTree()\n " + meta[endPos:]
+	return true
 }
-func (ch *ChDb) CreateTable(db, table, meta string) error {
-	meta = ReplaceAttachToCreateTable(db, table, meta)
+
+// RestoreName returns target database and table names after rewrite rules
+func (ch *ChDb) RestoreName(db, table string) (string, string) {
+	rdb, rtable := db, table
+	for _, rule := range ch.metaOpts.rewriteRules {
+		if !ruleMatched(rule, db, table) {
+			continue
+		}
+		if len(rule.NewDatabase) > 0 {
+			rdb = rule.NewDatabase
+		}
+		if len(rule.NewTable) > 0 && len(table) > 0 {
+			rtable = rule.NewTable
+		}
+	}
+	return rdb, rtable
+}
+
+// RestoreStoragePolicy returns storage policy of table after rewrite rules
+func (ch *ChDb) RestoreStoragePolicy(db, table, policy string) string {
+	for _, rule := range ch.metaOpts.rewriteRules {
+		if ruleMatched(rule, db, table) && len(rule.StoragePolicy) > 0 {
+			policy = rule.StoragePolicy
+		}
+	}
+	return policy
+}
+
+func applyRewriteRule(ddl *DDL, rule config.DDLRewriteRule) error {
+	if len(rule.Engine) > 0 {
+		if err := ddl.SetEngine(rule.Engine); err != nil {
+			return err
+		}
+	}
+	if len(rule.ZooKeeperPath) > 0 || len(rule.ReplicaName) > 0 {
+		if err := ddl.SetReplication(rule.ZooKeeperPath, rule.ReplicaName); err != nil {
+			return err
+		}
+	}
+	if len(rule.StoragePolicy) > 0 {
+		if err := ddl.SetStoragePolicy(rule.StoragePolicy); err != nil {
+			return err
+		}
+	}
+	for _, name := range rule.RemoveSettings {
+		if err := ddl.RemoveSetting(name); err != nil {
+			return err
+		}
+	}
+	for name, value := range rule.Settings {
+		if err := ddl.SetSetting(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteDDL prepare backuped table meta for create on restore server,
+// db and table are source names, rewrite rules may change it
+func (ch *ChDb) RewriteDDL(db, table, meta string) (string, error) {
+	ddl, err := ParseDDL(meta)
+	if err != nil {
+		return meta, err
+	}
+	rdb, rtable := ch.RestoreName(db, table)
+	if err := ddl.SetCreate(true); err != nil {
+		return meta, err
+	}
+	if err := ddl.SetName(rdb, rtable); err != nil {
+		return meta, err
+	}
+	// renamed table is a new table, UUID of source table may be still in use
+	if rdb != db || rtable != table {
+		if err := ddl.RemoveUUID(); err != nil {
+			return meta, err
+		}
+	}
+	if err := ddl.RemoveOnCluster(); err != nil {
+		return meta, err
+	}
 	if ch.metaOpts.cutReplicated {
-		meta = ReplaceCutReplicatedTable(meta)
+		if err := ddl.CutReplicated(); err != nil {
+			return meta, err
+		}
+	} else if len(ch.metaOpts.replicatedZkPath) > 0 && IsReplicatedEngine(ddl.Engine()) {
+		if err := ch.setReplication(ddl, rdb, rtable); err != nil {
+			return meta, err
+		}
+	}
+	for _, rule := range ch.metaOpts.rewriteRules {
+		if !ruleMatched(rule, db, table) {
+			continue
+		}
+		if err := applyRewriteRule(ddl, rule); err != nil {
+			return meta, err
+		}
+	}
+	return ddl.String(), nil
+}
+
+// setReplication rewrite ZooKeeper path and replica name from templates,
+// macros taken from system.macros of restore server
+func (ch *ChDb) setReplication(ddl *DDL, db, table string) error {
+	macros := map[string]string{}
+	chMacros, err := ch.GetMacros()
+	if err != nil {
+		return err
+	}
+	for k, v := range chMacros {
+		macros[k] = v
+	}
+	macros["database"] = db
+	macros["table"] = table
+	zkPath, err := ExpandMacros(ch.metaOpts.replicatedZkPath, macros)
+	if err != nil {
+		return err
+	}
+	replica, err := ExpandMacros(ch.metaOpts.replicatedReplica, macros)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replicated table `%s`.`%s` zookeeper path: %s replica: %s", db, table, zkPath, replica)
+	return ddl.SetReplication(zkPath, replica)
+}
+
+// CreateTable create table from backuped meta, db and table are source names
+func (ch *ChDb) CreateTable(db, table, meta string) error {
+	meta, err := ch.RewriteDDL(db, table, meta)
+	if err != nil {
+		return err
 	}
 	log.Printf("Create Table:\n%s", meta)
-	_, err := ch.Execute(meta)
+	_, err = ch.Execute(meta)
 	return err
 }
 func (ch *ChDb) ShowCreateTable(db, table string) (string, error) {
@@ -495,6 +1096,15 @@ func (ch *ChDb) AttachPartition(db, table, part string) error {
 	_, err := ch.Execute(query)
 	return err
 }
+
+// AttachPart attach one part from detached by part name
+func (ch *ChDb) AttachPart(db, table, part string) error {
+	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` ATTACH PART %s", db, table, QuoteString(part))
+	log.Printf("Attach part `%s`.`%s`.%s", db, table, part)
+	_, err := ch.Execute(query)
+	return err
+}
+
 func (ch *ChDb) AttachPartitionByDir(db, table, dir string) error {
 	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` ATTACH PARTITION ID '%s'", db, table, dir)
 	log.Printf("Attach Unknown part AS dir `%s`.`%s`.%s", db, table, dir)
@@ -524,7 +1134,6 @@ func GetStringFromMapInterface(m map[string]interface{}, k string) string {
 	default:
 		return ""
 	}
-	return ""
 }
 
 func GetStringsFromMapInterface(m map[string]interface{}, k string) []string {
@@ -539,5 +1148,4 @@ func GetStringsFromMapInterface(m map[string]interface{}, k string) []string {
 	default:
 		return []string{}
 	}
-	return []string{}
 }
@@ -2,9 +2,15 @@ package database
 
 import (
 	"cliback/config"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
 )
 
 var (
@@ -16,7 +22,15 @@ var (
 	}
 )
 
+// liveDB skip test without test clickhouse server
+func liveDB(t *testing.T) {
+	if err := Ping(testDSN); err != nil {
+		t.Skipf("Clickhouse %s not available: %v", testDSN.HostName, err)
+	}
+}
+
 func TestGetDBS(t *testing.T) {
+	liveDB(t)
 	ch := New()
 	ch.SetDSN(testDSN)
 	getDBS, err := ch.GetDBS()
@@ -32,6 +46,7 @@ func TestGetDBS(t *testing.T) {
 }
 
 func TestGetTables(t *testing.T) {
+	liveDB(t)
 	ch := New()
 	ch.SetDSN(testDSN)
 	tables, err := ch.GetTables("default")
@@ -47,6 +62,7 @@ func TestGetTables(t *testing.T) {
 }
 
 func TestGetPartitions(t *testing.T) {
+	liveDB(t)
 	ch := New()
 	ch.SetDSN(testDSN)
 	part, err := ch.GetPartitions("default", ".inner.visits_and_registrations", "")
@@ -61,15 +77,17 @@ func TestGetPartitions(t *testing.T) {
 	}
 }
 
-func TestGetFNames(t *testing.T) {
+// TestGetParts replaces TestGetFNames, part names are listed from system.parts
+func TestGetParts(t *testing.T) {
+	liveDB(t)
 	ch := New()
 	ch.SetDSN(testDSN)
-	part, err := ch.GetFNames("default", ".inner.visits_and_registrations", "")
+	parts, err := ch.GetParts("default", ".inner.visits_and_registrations")
 	if err == nil {
-		if len(part) < 1 {
-			t.Error("Number Partitions must be more then zero", part)
+		if len(parts) < 1 {
+			t.Error("Number Parts must be more then zero", parts)
 		} else {
-			fmt.Printf("Partitions: %s\n", part)
+			fmt.Printf("Parts: %v\n", parts)
 		}
 	} else {
 		t.Error("Fail connect to database", err)
@@ -77,6 +95,7 @@ func TestGetFNames(t *testing.T) {
 }
 
 func TestFreezeTable(t *testing.T) {
+	liveDB(t)
 	ch := New()
 	ch.SetDSN(testDSN)
 	err := ch.FreezeTable("default", ".inner.visits_and_registrations", "")
@@ -89,6 +108,7 @@ func TestFreezeTable(t *testing.T) {
 	}
 }
 func TestGetDisks(t *testing.T) {
+	liveDB(t)
 	ch := New()
 	ch.SetDSN(testDSN)
 	disks, err := ch.GetDisks()
@@ -109,7 +129,7 @@ func TestReplaceReplicatedMeta(t *testing.T) {
 }
 func TestReplaceReplicatedMetaV2(t *testing.T) {
 	meta := "ATTACH TABLE visit\n(\n`target` String,\n`ga_id` String,\n`campaign_id` Int32,\n`ip` String,\n`referrer` String,\n`datetime` DateTime,\n`type` String,\n`request_id` UUID,\n`partner_id` Int32,\n`manager_id` Int32,\n`date` Date\n)\nENGINE = ReplicatedMergeTree('/var/lib/clickhouse/first/visit', '{replica}', date, (request_id, date), 8192)"
-	metaExpect := "ATTACH TABLE visit\n(\n`target` String,\n`ga_id` String,\n`campaign_id` Int32,\n`ip` String,\n`referrer` String,\n`datetime` DateTime,\n`type` String,\n`request_id` UUID,\n`partner_id` Int32,\n`manager_id` Int32,\n`date` Date\n)\nENGINE = MergeTree(date,(request_id,date),8192)"
+	metaExpect := "ATTACH TABLE visit\n(\n`target` String,\n`ga_id` String,\n`campaign_id` Int32,\n`ip` String,\n`referrer` String,\n`datetime` DateTime,\n`type` String,\n`request_id` UUID,\n`partner_id` Int32,\n`manager_id` Int32,\n`date` Date\n)\nENGINE = MergeTree(date, (request_id, date), 8192)"
 	meta = ReplaceCutReplicatedTable(meta)
 	if meta != metaExpect {
 		t.Error("Meta replicationMergeTree BAD replace")
@@ -126,3 +146,48 @@ func TestPartRE(t *testing.T) {
 		t.Error("TestPartInt Fail is int")
 	}
 }
+
+func TestIsUnsupported(t *testing.T) {
+	if !IsUnsupported(&clickhouse.Exception{Code: 62, Message: "Syntax error"}) {
+		t.Error("syntax error not unsupported")
+	}
+	if IsUnsupported(&clickhouse.Exception{Code: 243, Message: "Not enough space"}) {
+		t.Error("not enough space is unsupported")
+	}
+	if IsUnsupported(errors.New("connection reset")) {
+		t.Error("network error is unsupported")
+	}
+}
+
+func TestReConnectLoopCancelled(t *testing.T) {
+	ch := new(ChDb)
+	ch.SetDSN(config.Connection{HostName: "127.0.0.1", Port: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch.SetContext(ctx)
+	start := time.Now()
+	if err := ch.ReConnectLoop(); err != context.Canceled {
+		t.Errorf("reconnect cancelled: %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("reconnect cancelled after %s", time.Since(start))
+	}
+}
+
+func TestGetMacrosParallel(t *testing.T) {
+	liveDB(t)
+	ch := new(ChDb)
+	ch.SetDSN(testDSN)
+	defer ch.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ch.GetMacros(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,779 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type ddlTokenKind int
+
+const (
+	tokSpace ddlTokenKind = iota
+	tokComment
+	tokWord
+	tokQuoted
+	tokString
+	tokPunct
+)
+
+type ddlToken struct {
+	kind ddlTokenKind
+	text string
+}
+
+type ddlClause struct {
+	start     int // keyword position
+	bodyStart int
+	end       int
+}
+
+type ddlSetting struct {
+	name       string
+	start      int
+	valueStart int
+	valueEnd   int
+}
+
+// DDL is a tokenized CREATE/ATTACH statement which can be rewritten
+// without touching comments, formatting and unrelated clauses
+type DDL struct {
+	tokens         []ddlToken
+	verb           int
+	objTypeEnd     int
+	ifNotExists    int
+	nameStart      int
+	nameEnd        int
+	database       string
+	table          string
+	uuid           [2]int
+	onCluster      [2]int
+	columns        [2]int
+	engine         int
+	engineName     int
+	argsOpen       int
+	argsClose      int
+	clauses        map[string]ddlClause
+	settings       []ddlSetting
+	structEnd      int
+	replicatedArgs int
+}
+
+var (
+	errDDLUnsupported = errors.New("Unsupported DDL statement")
+	errDDLNoEngine    = errors.New("DDL statement has no engine")
+)
+
+var ddlClauseKeywords = [][]string{
+	{"PARTITION", "BY"},
+	{"ORDER", "BY"},
+	{"PRIMARY", "KEY"},
+	{"SAMPLE", "BY"},
+	{"TTL"},
+	{"SETTINGS"},
+	{"COMMENT"},
+}
+
+func isWordChar(r byte) bool {
+	return r == '_' || r == '$' ||
+		(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+		r >= 0x80
+}
+
+func isSpaceChar(r byte) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' || r == '\v'
+}
+
+func tokenizeDDL(s string) ([]ddlToken, error) {
+	var result []ddlToken
+	for i := 0; i < len(s); {
+		start := i
+		switch r := s[i]; {
+		case isSpaceChar(r):
+			for i < len(s) && isSpaceChar(s[i]) {
+				i++
+			}
+			result = append(result, ddlToken{tokSpace, s[start:i]})
+		case r == '-' && i+1 < len(s) && s[i+1] == '-':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			result = append(result, ddlToken{tokComment, s[start:i]})
+		case r == '/' && i+1 < len(s) && s[i+1] == '*':
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, errors.New("Unterminated comment in DDL")
+			}
+			i += end + 4
+			result = append(result, ddlToken{tokComment, s[start:i]})
+		case r == '\'' || r == '`' || r == '"':
+			i++
+			for {
+				if i >= len(s) {
+					return nil, fmt.Errorf("Unterminated quote %c in DDL", r)
+				}
+				if s[i] == '\\' {
+					i += 2
+					continue
+				}
+				if s[i] == r {
+					if i+1 < len(s) && s[i+1] == r {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			kind := tokQuoted
+			if r == '\'' {
+				kind = tokString
+			}
+			result = append(result, ddlToken{kind, s[start:i]})
+		case isWordChar(r):
+			for i < len(s) && isWordChar(s[i]) {
+				i++
+			}
+			result = append(result, ddlToken{tokWord, s[start:i]})
+		default:
+			i++
+			result = append(result, ddlToken{tokPunct, s[start:i]})
+		}
+	}
+	return result, nil
+}
+
+func unquote(t ddlToken) string {
+	if t.kind != tokQuoted && t.kind != tokString {
+		return t.text
+	}
+	q := t.text[0]
+	body := t.text[1 : len(t.text)-1]
+	var sb strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] == '\\' && i+1 < len(body) {
+			i++
+			switch body[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				sb.WriteByte(body[i])
+			}
+			continue
+		}
+		if body[i] == q && i+1 < len(body) && body[i+1] == q {
+			i++
+		}
+		sb.WriteByte(body[i])
+	}
+	return sb.String()
+}
+
+// QuoteIdent returns backquoted ClickHouse identifier
+func QuoteIdent(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return "`" + strings.Replace(s, "`", "\\`", -1) + "`"
+}
+
+// QuoteString returns single quoted ClickHouse string literal
+func QuoteString(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	return "'" + strings.Replace(s, "'", "\\'", -1) + "'"
+}
+
+// ParseDDL tokenize and index CREATE/ATTACH statement
+func ParseDDL(meta string) (*DDL, error) {
+	tokens, err := tokenizeDDL(meta)
+	if err != nil {
+		return nil, err
+	}
+	d := &DDL{tokens: tokens}
+	err = d.index()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DDL) String() string {
+	var sb strings.Builder
+	for _, t := range d.tokens {
+		sb.WriteString(t.text)
+	}
+	return sb.String()
+}
+
+func (d *DDL) next(i int) int {
+	for i++; i < len(d.tokens); i++ {
+		if d.tokens[i].kind != tokSpace && d.tokens[i].kind != tokComment {
+			return i
+		}
+	}
+	return len(d.tokens)
+}
+
+func (d *DDL) isWord(i int, words ...string) bool {
+	for _, w := range words {
+		if i >= len(d.tokens) || d.tokens[i].kind != tokWord || !strings.EqualFold(d.tokens[i].text, w) {
+			return false
+		}
+		i = d.next(i)
+	}
+	return true
+}
+
+func (d *DDL) isPunct(i int, p string) bool {
+	return i < len(d.tokens) && d.tokens[i].kind == tokPunct && d.tokens[i].text == p
+}
+
+// skipWords returns position after the words sequence
+func (d *DDL) skipWords(i, n int) int {
+	for ; n > 1; n-- {
+		i = d.next(i)
+	}
+	return i + 1
+}
+
+func (d *DDL) matching(open int) int {
+	depth := 0
+	for i := open; i < len(d.tokens); i++ {
+		if d.isPunct(i, "(") || d.isPunct(i, "[") {
+			depth++
+		} else if d.isPunct(i, ")") || d.isPunct(i, "]") {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (d *DDL) clauseAt(i int) []string {
+	for _, kw := range ddlClauseKeywords {
+		if d.isWord(i, kw...) {
+			return kw
+		}
+	}
+	return nil
+}
+
+func (d *DDL) index() error {
+	d.verb, d.ifNotExists, d.engine, d.engineName, d.argsOpen, d.argsClose = -1, -1, -1, -1, -1, -1
+	d.uuid, d.onCluster, d.columns = [2]int{-1, -1}, [2]int{-1, -1}, [2]int{-1, -1}
+	d.clauses = map[string]ddlClause{}
+	d.settings = nil
+	d.database, d.table = "", ""
+
+	i := d.next(-1)
+	if !d.isWord(i, "CREATE") && !d.isWord(i, "ATTACH") {
+		return errDDLUnsupported
+	}
+	d.verb = i
+	i = d.next(i)
+	if d.isWord(i, "OR", "REPLACE") {
+		i = d.next(d.next(i))
+	}
+	if d.isWord(i, "TEMPORARY") {
+		i = d.next(i)
+	}
+	switch {
+	case d.isWord(i, "MATERIALIZED", "VIEW"), d.isWord(i, "LIVE", "VIEW"):
+		i = d.next(i)
+		d.objTypeEnd = i + 1
+	case d.isWord(i, "TABLE"), d.isWord(i, "VIEW"), d.isWord(i, "DICTIONARY"):
+		d.objTypeEnd = i + 1
+	default:
+		return errDDLUnsupported
+	}
+	i = d.next(i)
+	if d.isWord(i, "IF", "NOT", "EXISTS") {
+		d.ifNotExists = i
+		i = d.next(d.next(d.next(i)))
+	}
+	if i >= len(d.tokens) || (d.tokens[i].kind != tokWord && d.tokens[i].kind != tokQuoted) {
+		return errors.New("DDL statement has no object name")
+	}
+	d.nameStart, d.nameEnd = i, i+1
+	d.table = unquote(d.tokens[i])
+	if j := d.next(i); d.isPunct(j, ".") {
+		k := d.next(j)
+		if k >= len(d.tokens) || (d.tokens[k].kind != tokWord && d.tokens[k].kind != tokQuoted) {
+			return errors.New("DDL statement has bad object name")
+		}
+		d.database, d.table = d.table, unquote(d.tokens[k])
+		d.nameEnd = k + 1
+	}
+
+	var lastClause string
+	closeClause := func(end int) {
+		if lastClause != "" {
+			cl := d.clauses[lastClause]
+			cl.end = end
+			d.clauses[lastClause] = cl
+			lastClause = ""
+		}
+	}
+	d.structEnd = len(d.tokens)
+	for i = d.next(d.nameEnd - 1); i < len(d.tokens); i = d.next(i) {
+		switch {
+		case d.isPunct(i, ";"), d.isWord(i, "AS"):
+			d.structEnd = i
+		case d.isWord(i, "UUID") && d.next(i) < len(d.tokens) && d.tokens[d.next(i)].kind == tokString:
+			d.uuid = [2]int{i, d.next(i) + 1}
+			i = d.next(i)
+			continue
+		case d.isWord(i, "ON", "CLUSTER"):
+			j := d.next(d.next(i))
+			d.onCluster = [2]int{i, j + 1}
+			i = j
+			continue
+		case d.isPunct(i, "(") && d.engine < 0 && d.columns[0] < 0 && lastClause == "":
+			d.columns = [2]int{i, d.matching(i)}
+			if d.columns[1] < 0 {
+				return errors.New("Unbalanced brackets in DDL")
+			}
+			i = d.columns[1]
+			continue
+		case d.isWord(i, "ENGINE") && lastClause == "":
+			d.engine = i
+			j := d.next(i)
+			if d.isPunct(j, "=") {
+				j = d.next(j)
+			}
+			if j >= len(d.tokens) || d.tokens[j].kind != tokWord {
+				return errors.New("DDL statement has bad engine")
+			}
+			d.engineName = j
+			i = j
+			if k := d.next(j); d.isPunct(k, "(") {
+				d.argsOpen, d.argsClose = k, d.matching(k)
+				if d.argsClose < 0 {
+					return errors.New("Unbalanced brackets in DDL")
+				}
+				i = d.argsClose
+			}
+			continue
+		default:
+			if kw := d.clauseAt(i); kw != nil {
+				closeClause(i)
+				lastClause = strings.Join(kw, " ")
+				d.clauses[lastClause] = ddlClause{start: i, bodyStart: d.skipWords(i, len(kw))}
+				i = d.skipWords(i, len(kw)) - 1
+				continue
+			}
+			if d.isPunct(i, "(") || d.isPunct(i, "[") {
+				if m := d.matching(i); m >= 0 {
+					i = m
+				}
+			}
+			continue
+		}
+		break
+	}
+	closeClause(d.structEnd)
+	d.indexSettings()
+	return nil
+}
+
+func (d *DDL) indexSettings() {
+	cl, ok := d.clauses["SETTINGS"]
+	if !ok {
+		return
+	}
+	for _, item := range d.splitTopLevel(cl.bodyStart, cl.end) {
+		name := d.next(item[0] - 1)
+		eq := d.next(name)
+		if name >= item[1] || !d.isPunct(eq, "=") {
+			continue
+		}
+		vs := d.next(eq)
+		d.settings = append(d.settings, ddlSetting{
+			name:       strings.ToLower(d.tokens[name].text),
+			start:      name,
+			valueStart: vs,
+			valueEnd:   d.trimRight(vs, item[1]),
+		})
+	}
+}
+
+// splitTopLevel returns [start,end) ranges of comma separated items
+func (d *DDL) splitTopLevel(start, end int) [][2]int {
+	var result [][2]int
+	itemStart := start
+	for i := start; i < end; i++ {
+		if d.isPunct(i, "(") || d.isPunct(i, "[") {
+			if m := d.matching(i); m >= 0 {
+				i = m
+			}
+			continue
+		}
+		if d.isPunct(i, ",") {
+			result = append(result, [2]int{itemStart, i})
+			itemStart = i + 1
+		}
+	}
+	if d.next(itemStart-1) < end {
+		result = append(result, [2]int{itemStart, end})
+	}
+	return result
+}
+
+// trimRight returns end of range without trailing spaces and comments
+func (d *DDL) trimRight(start, end int) int {
+	for end > start && (d.tokens[end-1].kind == tokSpace || d.tokens[end-1].kind == tokComment) {
+		end--
+	}
+	return end
+}
+
+func (d *DDL) text(start, end int) string {
+	var sb strings.Builder
+	for i := start; i < end && i < len(d.tokens); i++ {
+		sb.WriteString(d.tokens[i].text)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func (d *DDL) replace(start, end int, repl string) error {
+	toks, err := tokenizeDDL(repl)
+	if err != nil {
+		return err
+	}
+	tokens := make([]ddlToken, 0, len(d.tokens)-(end-start)+len(toks))
+	tokens = append(tokens, d.tokens[:start]...)
+	tokens = append(tokens, toks...)
+	tokens = append(tokens, d.tokens[end:]...)
+	old := d.tokens
+	d.tokens = tokens
+	if err := d.index(); err != nil {
+		d.tokens = old
+		_ = d.index()
+		return err
+	}
+	return nil
+}
+
+// remove deletes range with preceding whitespace
+func (d *DDL) remove(start, end int) error {
+	for start > 0 && d.tokens[start-1].kind == tokSpace {
+		start--
+	}
+	return d.replace(start, end, "")
+}
+
+// Name returns database (may be empty) and object name
+func (d *DDL) Name() (string, string) {
+	return d.database, d.table
+}
+
+// SetName replace object name with fully qualified `db`.`table`
+func (d *DDL) SetName(db, table string) error {
+	name := QuoteIdent(table)
+	if len(db) > 0 {
+		name = QuoteIdent(db) + "." + name
+	}
+	return d.replace(d.nameStart, d.nameEnd, name)
+}
+
+// SetCreate converts ATTACH statement to CREATE, optionally with IF NOT EXISTS
+func (d *DDL) SetCreate(ifNotExists bool) error {
+	if err := d.replace(d.verb, d.verb+1, "CREATE"); err != nil {
+		return err
+	}
+	if ifNotExists && d.ifNotExists < 0 {
+		return d.replace(d.objTypeEnd, d.objTypeEnd, " IF NOT EXISTS")
+	}
+	return nil
+}
+
+// RemoveUUID drops UUID 'xxx' from statement
+func (d *DDL) RemoveUUID() error {
+	if d.uuid[0] < 0 {
+		return nil
+	}
+	return d.remove(d.uuid[0], d.uuid[1])
+}
+
+// RemoveOnCluster drops ON CLUSTER clause from statement
+func (d *DDL) RemoveOnCluster() error {
+	if d.onCluster[0] < 0 {
+		return nil
+	}
+	return d.remove(d.onCluster[0], d.onCluster[1])
+}
+
+// Engine returns table engine name
+func (d *DDL) Engine() string {
+	if d.engineName < 0 {
+		return ""
+	}
+	return d.tokens[d.engineName].text
+}
+
+// EngineArgs returns engine arguments as written in statement
+func (d *DDL) EngineArgs() []string {
+	var result []string
+	if d.argsOpen < 0 {
+		return result
+	}
+	for _, item := range d.splitTopLevel(d.argsOpen+1, d.argsClose) {
+		result = append(result, d.text(item[0], item[1]))
+	}
+	return result
+}
+
+// Clause returns body of top level clause e.g. "ORDER BY", "PARTITION BY"
+func (d *DDL) Clause(name string) string {
+	cl, ok := d.clauses[strings.ToUpper(name)]
+	if !ok {
+		return ""
+	}
+	return d.text(cl.bodyStart, cl.end)
+}
+
+// Columns returns columns definition block without brackets
+func (d *DDL) Columns() string {
+	if d.columns[0] < 0 {
+		return ""
+	}
+	return d.text(d.columns[0]+1, d.columns[1])
+}
+
+// IsReplicatedEngine tells whether engine name is Replicated*MergeTree
+func IsReplicatedEngine(engine string) bool {
+	return strings.HasPrefix(engine, "Replicated") && strings.HasSuffix(engine, "MergeTree")
+}
+
+// replicationArgs returns positions of ZooKeeper path and replica name string args
+func (d *DDL) replicationArgs() [][2]int {
+	if d.argsOpen < 0 {
+		return nil
+	}
+	items := d.splitTopLevel(d.argsOpen+1, d.argsClose)
+	if len(items) < 2 {
+		return nil
+	}
+	for _, item := range items[:2] {
+		first := d.next(item[0] - 1)
+		if first >= item[1] || d.tokens[first].kind != tokString || d.next(first) < item[1] {
+			return nil
+		}
+	}
+	return items[:2]
+}
+
+// ZooKeeperPath returns ZooKeeper path and replica name of Replicated engine
+func (d *DDL) ZooKeeperPath() (string, string) {
+	if !IsReplicatedEngine(d.Engine()) {
+		return "", ""
+	}
+	ra := d.replicationArgs()
+	if ra == nil {
+		return "", ""
+	}
+	return unquote(d.tokens[d.next(ra[0][0]-1)]), unquote(d.tokens[d.next(ra[1][0]-1)])
+}
+
+// SetEngine changes engine name, ZooKeeper args dropped for non Replicated engine
+func (d *DDL) SetEngine(engine string) error {
+	if d.engineName < 0 {
+		return errDDLNoEngine
+	}
+	if IsReplicatedEngine(d.Engine()) && !IsReplicatedEngine(engine) {
+		if ra := d.replicationArgs(); ra != nil {
+			end := d.argsClose
+			if items := d.splitTopLevel(d.argsOpen+1, d.argsClose); len(items) > 2 {
+				end = d.next(items[2][0] - 1)
+			}
+			if err := d.replace(d.argsOpen+1, end, ""); err != nil {
+				return err
+			}
+		}
+	}
+	if d.argsOpen < 0 && strings.HasSuffix(engine, "MergeTree") {
+		return d.replace(d.engineName, d.engineName+1, engine+"()")
+	}
+	return d.replace(d.engineName, d.engineName+1, engine)
+}
+
+// CutReplicated converts Replicated*MergeTree to *MergeTree
+func (d *DDL) CutReplicated() error {
+	engine := d.Engine()
+	if !IsReplicatedEngine(engine) {
+		return nil
+	}
+	return d.SetEngine(strings.TrimPrefix(engine, "Replicated"))
+}
+
+// SetReplication set ZooKeeper path and replica name for Replicated engine,
+// empty values are kept as is
+func (d *DDL) SetReplication(zkPath, replica string) error {
+	if !IsReplicatedEngine(d.Engine()) {
+		return fmt.Errorf("Engine %s is not Replicated", d.Engine())
+	}
+	if ra := d.replicationArgs(); ra != nil {
+		if len(replica) > 0 {
+			if err := d.replace(ra[1][0], ra[1][1], " "+QuoteString(replica)); err != nil {
+				return err
+			}
+		}
+		if len(zkPath) > 0 {
+			ra = d.replicationArgs()
+			return d.replace(ra[0][0], ra[0][1], QuoteString(zkPath))
+		}
+		return nil
+	}
+	if len(zkPath) < 1 || len(replica) < 1 {
+		return errors.New("ZooKeeper path and replica name required for Replicated engine")
+	}
+	args := QuoteString(zkPath) + ", " + QuoteString(replica)
+	if d.argsOpen < 0 {
+		return d.replace(d.engineName+1, d.engineName+1, "("+args+")")
+	}
+	if len(d.EngineArgs()) > 0 {
+		args += ", "
+	}
+	return d.replace(d.argsOpen+1, d.argsOpen+1, args)
+}
+
+// Setting returns raw value of table setting
+func (d *DDL) Setting(name string) (string, bool) {
+	for _, s := range d.settings {
+		if s.name == strings.ToLower(name) {
+			return d.text(s.valueStart, s.valueEnd), true
+		}
+	}
+	return "", false
+}
+
+// SetSetting set raw value of table setting, added if not exists
+func (d *DDL) SetSetting(name, value string) error {
+	for _, s := range d.settings {
+		if s.name == strings.ToLower(name) {
+			return d.replace(s.valueStart, s.valueEnd, value)
+		}
+	}
+	if len(d.settings) > 0 {
+		last := d.settings[len(d.settings)-1]
+		return d.replace(last.valueEnd, last.valueEnd, fmt.Sprintf(", %s = %s", name, value))
+	}
+	if d.engine < 0 {
+		return errDDLNoEngine
+	}
+	pos := d.trimRight(d.engine, d.structEnd)
+	if cl, ok := d.clauses["COMMENT"]; ok {
+		pos = d.trimRight(d.engine, cl.start)
+	}
+	return d.replace(pos, pos, fmt.Sprintf("\nSETTINGS %s = %s", name, value))
+}
+
+// RemoveSetting drops table setting, SETTINGS clause dropped if empty
+func (d *DDL) RemoveSetting(name string) error {
+	for i, s := range d.settings {
+		if s.name != strings.ToLower(name) {
+			continue
+		}
+		if len(d.settings) == 1 {
+			cl := d.clauses["SETTINGS"]
+			return d.remove(cl.start, d.trimRight(cl.start, cl.end))
+		}
+		if i == len(d.settings)-1 {
+			return d.replace(d.settings[i-1].valueEnd, s.valueEnd, "")
+		}
+		return d.replace(s.start, d.settings[i+1].start, "")
+	}
+	return nil
+}
+
+// SetStoragePolicy set storage_policy table setting
+func (d *DDL) SetStoragePolicy(policy string) error {
+	return d.SetSetting("storage_policy", QuoteString(policy))
+}
+
+var columnAttrKeywords = []string{"DEFAULT", "MATERIALIZED", "ALIAS", "EPHEMERAL", "CODEC", "COMMENT", "TTL"}
+
+// compact returns text of range without spaces, comments and identifier quotes
+func (d *DDL) compact(start, end int) string {
+	var sb strings.Builder
+	for i := start; i < end && i < len(d.tokens); i++ {
+		switch d.tokens[i].kind {
+		case tokSpace, tokComment:
+		case tokQuoted:
+			sb.WriteString(unquote(d.tokens[i]))
+		default:
+			sb.WriteString(d.tokens[i].text)
+		}
+	}
+	return sb.String()
+}
+
+// ColumnTypes returns [name, type] of columns, indexes, projections and constraints skipped
+func (d *DDL) ColumnTypes() [][2]string {
+	var result [][2]string
+	if d.columns[0] < 0 {
+		return result
+	}
+	for _, item := range d.splitTopLevel(d.columns[0]+1, d.columns[1]) {
+		name := d.next(item[0] - 1)
+		if name >= item[1] || d.isWord(name, "INDEX") || d.isWord(name, "PROJECTION") || d.isWord(name, "CONSTRAINT") {
+			continue
+		}
+		typeStart := d.next(name)
+		typeEnd := item[1]
+	attrs:
+		for i := typeStart; i < item[1]; i = d.next(i) {
+			for _, kw := range columnAttrKeywords {
+				if d.isWord(i, kw) {
+					typeEnd = i
+					break attrs
+				}
+			}
+			if d.isPunct(i, "(") {
+				if m := d.matching(i); m >= 0 {
+					i = m
+				}
+			}
+		}
+		result = append(result, [2]string{unquote(d.tokens[name]), d.compact(typeStart, typeEnd)})
+	}
+	return result
+}
+
+// CompareSchema check columns, sorting key and partition key of actual table meta against expected
+func CompareSchema(expected, actual string) error {
+	exp, err := ParseDDL(expected)
+	if err != nil {
+		return err
+	}
+	act, err := ParseDDL(actual)
+	if err != nil {
+		return err
+	}
+	expCols, actCols := exp.ColumnTypes(), act.ColumnTypes()
+	if len(expCols) != len(actCols) {
+		return fmt.Errorf("Columns count %d not eq backup columns count %d", len(actCols), len(expCols))
+	}
+	for i := range expCols {
+		if expCols[i] != actCols[i] {
+			return fmt.Errorf("Column `%s` %s not eq backup column `%s` %s", actCols[i][0], actCols[i][1], expCols[i][0], expCols[i][1])
+		}
+	}
+	for _, clause := range []string{"ORDER BY", "PARTITION BY"} {
+		expCl, actCl := exp.clauses[clause], act.clauses[clause]
+		expText, actText := "", ""
+		if _, ok := exp.clauses[clause]; ok {
+			expText = exp.compact(expCl.bodyStart, expCl.end)
+		}
+		if _, ok := act.clauses[clause]; ok {
+			actText = act.compact(actCl.bodyStart, actCl.end)
+		}
+		if expText != actText {
+			return fmt.Errorf("%s %s not eq backup %s %s", clause, actText, clause, expText)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"cliback/config"
+	"strings"
+	"testing"
+)
+
+func TestDDLAttachToCreate(t *testing.T) {
+	meta := "ATTACH TABLE _ UUID 'a5e4f6c2-1b3d-4d2e-9f00-000000000001'\n(\n    `id` UInt64,\n    `d` Date\n)\nENGINE = MergeTree\nORDER BY id\nSETTINGS index_granularity = 8192\n"
+	expect := "CREATE TABLE IF NOT EXISTS `db`.`my table` UUID 'a5e4f6c2-1b3d-4d2e-9f00-000000000001'\n(\n    `id` UInt64,\n    `d` Date\n)\nENGINE = MergeTree\nORDER BY id\nSETTINGS index_granularity = 8192\n"
+	if res := ReplaceAttachToCreateTable("db", "my table", meta); res != expect {
+		t.Errorf("Bad attach replace:\n%s", res)
+	}
+}
+
+func TestDDLCutReplicatedWithComments(t *testing.T) {
+	meta := "CREATE TABLE `my db`.`events` ON CLUSTER main -- ENGINE = Log\n(\n    `id` UInt64, /* ORDER BY fake */\n    `s` String DEFAULT 'PARTITION BY, ORDER BY'\n)\nENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/{shard}/events', '{replica}', ver)\nPARTITION BY toYYYYMM(d)\nORDER BY (id, s)\nSETTINGS index_granularity = 8192, storage_policy = 'ssd'"
+	ddl, err := ParseDDL(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db, table := ddl.Name(); db != "my db" || table != "events" {
+		t.Errorf("Bad name parsed: %s.%s", db, table)
+	}
+	zk, replica := ddl.ZooKeeperPath()
+	if zk != "/clickhouse/tables/{shard}/events" || replica != "{replica}" {
+		t.Errorf("Bad zookeeper args parsed: %s %s", zk, replica)
+	}
+	if err := ddl.CutReplicated(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ddl.RemoveOnCluster(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "CREATE TABLE `my db`.`events` -- ENGINE = Log\n(\n    `id` UInt64, /* ORDER BY fake */\n    `s` String DEFAULT 'PARTITION BY, ORDER BY'\n)\nENGINE = ReplacingMergeTree(ver)\nPARTITION BY toYYYYMM(d)\nORDER BY (id, s)\nSETTINGS index_granularity = 8192, storage_policy = 'ssd'"
+	if ddl.String() != expect {
+		t.Errorf("Bad cut replicated:\n%s", ddl.String())
+	}
+	if ddl.Clause("ORDER BY") != "(id, s)" || ddl.Clause("PARTITION BY") != "toYYYYMM(d)" {
+		t.Errorf("Bad clauses parsed: %s / %s", ddl.Clause("ORDER BY"), ddl.Clause("PARTITION BY"))
+	}
+}
+
+func TestDDLSettings(t *testing.T) {
+	ddl, err := ParseDDL("CREATE TABLE t (`id` UInt64) ENGINE = MergeTree() ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ddl.SetStoragePolicy("nvme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ddl.SetSetting("index_granularity", "1024"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "CREATE TABLE t (`id` UInt64) ENGINE = MergeTree() ORDER BY id\nSETTINGS storage_policy = 'nvme', index_granularity = 1024"
+	if ddl.String() != expect {
+		t.Errorf("Bad settings add:\n%s", ddl.String())
+	}
+	if v, _ := ddl.Setting("storage_policy"); v != "'nvme'" {
+		t.Errorf("Bad setting value: %s", v)
+	}
+	if err := ddl.RemoveSetting("storage_policy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ddl.RemoveSetting("index_granularity"); err != nil {
+		t.Fatal(err)
+	}
+	if ddl.String() != "CREATE TABLE t (`id` UInt64) ENGINE = MergeTree() ORDER BY id" {
+		t.Errorf("Bad settings remove:\n%s", ddl.String())
+	}
+}
+
+func TestDDLRewriteRules(t *testing.T) {
+	ch := &ChDb{}
+	ch.SetMetaOpts(config.ChMetaOpts{
+		DDLRewrite: []config.DDLRewriteRule{
+			{Database: "stage_*", NewDatabase: "prod"},
+			{Table: "events", Engine: "ReplicatedMergeTree", ZooKeeperPath: "/ch/{shard}/events", ReplicaName: "{replica}"},
+		},
+	})
+	meta := "CREATE TABLE stage_1.events (`id` UInt64) ENGINE = MergeTree ORDER BY id"
+	res, err := ch.RewriteDDL("stage_1", "events", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "CREATE TABLE IF NOT EXISTS `prod`.`events` (`id` UInt64) ENGINE = ReplicatedMergeTree('/ch/{shard}/events', '{replica}') ORDER BY id"
+	if res != expect {
+		t.Errorf("Bad rewrite:\n%s", res)
+	}
+}
+
+func TestDDLReplicatedMacros(t *testing.T) {
+	ch := &ChDb{macros: map[string]string{"shard": "02", "replica": "ch-2-1"}}
+	ch.SetMetaOpts(config.ChMetaOpts{ReplicatedZkPath: "/clickhouse/tables/{shard}/{database}/{table}"})
+	meta := "CREATE TABLE db.t (`id` UInt64) ENGINE = ReplicatedMergeTree('/old/path/t', 'old') ORDER BY id"
+	res, err := ch.RewriteDDL("db", "t", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "CREATE TABLE IF NOT EXISTS `db`.`t` (`id` UInt64) ENGINE = ReplicatedMergeTree('/clickhouse/tables/02/db/t', 'ch-2-1') ORDER BY id"
+	if res != expect {
+		t.Errorf("Bad replicated rewrite:\n%s", res)
+	}
+	if _, err := ExpandMacros("/{layer}/{table}", ch.macros); err == nil {
+		t.Error("Unknown macro must fail")
+	}
+}
+
+func TestDDLCompareSchema(t *testing.T) {
+	backup := "ATTACH TABLE _ UUID 'a5e4f6c2-1b3d-4d2e-9f00-000000000001'\n(\n    `id` UInt64,\n    `s` Nullable(String) DEFAULT 'a, b' CODEC(ZSTD(1)),\n    INDEX ix s TYPE bloom_filter GRANULARITY 1\n)\nENGINE = MergeTree\nPARTITION BY toYYYYMM(d)\nORDER BY (id, s)\nSETTINGS index_granularity = 8192"
+	same := "CREATE TABLE db.t\n(\n    id UInt64,\n    s Nullable(String) COMMENT 'new'\n)\nENGINE = ReplicatedMergeTree('/zk', '{replica}')\nPARTITION BY toYYYYMM(d)\nORDER BY (id,s)"
+	if err := CompareSchema(backup, same); err != nil {
+		t.Errorf("Same schema must match: %v", err)
+	}
+	for _, other := range []string{
+		"CREATE TABLE db.t (id UInt32, s Nullable(String)) ENGINE = MergeTree PARTITION BY toYYYYMM(d) ORDER BY (id, s)",
+		"CREATE TABLE db.t (id UInt64) ENGINE = MergeTree PARTITION BY toYYYYMM(d) ORDER BY (id, s)",
+		"CREATE TABLE db.t (id UInt64, s Nullable(String)) ENGINE = MergeTree PARTITION BY d ORDER BY (id, s)",
+		"CREATE TABLE db.t (id UInt64, s Nullable(String)) ENGINE = MergeTree PARTITION BY toYYYYMM(d) ORDER BY id",
+	} {
+		if err := CompareSchema(backup, other); err == nil {
+			t.Errorf("Schema must differ:\n%s", other)
+		}
+	}
+}
+
+func TestDDLRenameRemoveUUID(t *testing.T) {
+	ch := &ChDb{}
+	ch.SetMetaOpts(config.ChMetaOpts{DDLRewrite: []config.DDLRewriteRule{{Database: "db", Table: "t", NewTable: "t_copy"}}})
+	meta := "ATTACH TABLE _ UUID 'a5e4f6c2-1b3d-4d2e-9f00-000000000001' (`id` UInt64) ENGINE = MergeTree ORDER BY id"
+	res, err := ch.RewriteDDL("db", "t", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(res, "UUID") {
+		t.Errorf("Renamed table keeps UUID:\n%s", res)
+	}
+	res, err = ch.RewriteDDL("db", "other", meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res, "UUID") {
+		t.Errorf("Not renamed table lost UUID:\n%s", res)
+	}
+}
@@ -3,24 +3,43 @@ package main
 import (
 	"cliback/backup"
 	"cliback/config"
+	"cliback/report"
+	"cliback/sftp_pool"
 	"cliback/status"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 type MainArgs struct {
-	configFile  string
-	backupMode  bool
-	restoreMode bool
-	infoMode    bool
-	debug       bool
-	version     bool
-	jobID       string
-	partID      string
-	backupType  string
+	configFile    string
+	backupMode    bool
+	restoreMode   bool
+	infoMode      bool
+	cleanupMode   bool
+	dryRun        bool
+	debug         bool
+	version       bool
+	jobID         string
+	partID        string
+	backupType    string
+	cluster       string
+	shard         uint
+	reportFile    string
+	priority      string
+	restoreParts  string
+	backupFilter  string
+	restoreFilter string
+	exclude       string
+	dataOnly      bool
+	onConflict    string
+	staging       bool
 }
 
 func (ma *MainArgs) parseMode() error {
@@ -34,13 +53,44 @@ func (ma *MainArgs) parseMode() error {
 	if ma.infoMode {
 		modeCount++
 	}
+	if ma.cleanupMode {
+		modeCount++
+	}
 	if ma.version {
 		modeCount++
 	}
 	if modeCount == 1 {
 		return nil
 	}
-	return errors.New("Bad command line args usage: backup/restore/info")
+	return errors.New("Bad command line args usage: backup/restore/info/cleanup")
+}
+
+// signalContext cancel ctx on first SIGINT/SIGTERM, next signal kill process as default
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Printf("Got signal %v, stop job and cleanup. Send again for immediate exit", sig)
+		cancel()
+	}()
+	return ctx
+}
+
+func jobTypeName(t config.RunJobType) string {
+	switch t {
+	case config.Backup:
+		return "backup"
+	case config.Restore:
+		return "restore"
+	case config.Info:
+		return "info"
+	case config.Cleanup:
+		return "cleanup"
+	}
+	return ""
 }
 
 // Contains tells whether a contains x.
@@ -61,18 +111,31 @@ func main() {
 	flag.BoolVar(&cargs.backupMode, "b", false, "Run backup job (shotland)")
 	flag.BoolVar(&cargs.infoMode, "info", false, "Get Info about backups")
 	flag.BoolVar(&cargs.infoMode, "i", false, "Get Info about backups (shotland)")
+	flag.BoolVar(&cargs.cleanupMode, "cleanup", false, "Remove leftovers of crashed jobs: cliback shadow dirs and restored parts in detached")
+	flag.BoolVar(&cargs.dryRun, "dry-run", false, "Cleanup only report, nothing removed")
 	flag.BoolVar(&cargs.version, "version", false, "Get version")
 	flag.BoolVar(&cargs.version, "v", false, "Get version (shotland)")
 	flag.BoolVar(&cargs.debug, "debug", false, "Debug messages")
 	flag.BoolVar(&cargs.debug, "d", false, "Debug messages (shotland)")
 	flag.StringVar(&cargs.configFile, "config", "clickhouse_backup.yaml", "path to config file")
 	flag.StringVar(&cargs.configFile, "c", "clickhouse_backup.yaml", "path to config file (shotland)")
-	flag.StringVar(&cargs.jobID, "jobid", "", "JobId for restore")
-	flag.StringVar(&cargs.jobID, "j", "", "JobId for restore (shotland)")
-	flag.StringVar(&cargs.backupType, "backup-type", "", "Backup type (default: full)")
-	flag.StringVar(&cargs.backupType, "t", "", "Backup type (default: full) (shotland)")
-	flag.StringVar(&cargs.partID, "partid", "", "PartId for backup OR restore ")
-	flag.StringVar(&cargs.partID, "p", "", "PartId for backup OR restore (shotland)")
+	flag.StringVar(&cargs.jobID, "jobid", "", "JobId for restore or cluster backup (same on all hosts)")
+	flag.StringVar(&cargs.jobID, "j", "", "JobId for restore or cluster backup (shotland)")
+	flag.StringVar(&cargs.backupType, "backup-type", "", "Backup type full, diff, incr, part, schema (DDL only) (default: full)")
+	flag.StringVar(&cargs.backupType, "t", "", "Backup type full, diff, incr, part, schema (DDL only) (default: full) (shotland)")
+	flag.StringVar(&cargs.partID, "partid", "", "Partition selector for part backup, all tables: 202101,2021%,202101..202106,since:2021-06-01 ")
+	flag.StringVar(&cargs.partID, "p", "", "Partition selector for part backup (shotland)")
+	flag.StringVar(&cargs.cluster, "cluster", "", "Cluster name from system.clusters for backup OR restore by shards, backup needs -j")
+	flag.UintVar(&cargs.shard, "shard", 0, "Shard number for cluster backup OR restore (default: local shard)")
+	flag.StringVar(&cargs.priority, "priority", "", "Restore first tables db.table,db2.* (comma separated, glob)")
+	flag.StringVar(&cargs.restoreParts, "restore-partitions", "", "Restore only partitions/parts db.t:202105,202106,part:202107_*;db2.t2:2021% (overrides restore_partitions)")
+	flag.StringVar(&cargs.backupFilter, "backup-filter", "", "Backup only db,db.table (comma separated, glob or /regexp/), overrides backup_filter")
+	flag.StringVar(&cargs.restoreFilter, "restore-filter", "", "Restore only db,db.table (comma separated, glob or /regexp/), overrides restore_filter")
+	flag.StringVar(&cargs.exclude, "exclude", "", "Skip db,db.table (comma separated, glob or /regexp/), overrides backup_exclude and restore_exclude")
+	flag.BoolVar(&cargs.dataOnly, "data-only", false, "Restore data into existing tables, schema checked against backup, no databases/tables created")
+	flag.StringVar(&cargs.onConflict, "on-conflict", "", "Restore into table with data: fail, skip, replace-table (with -staging), replace-partition, append (default: append)")
+	flag.BoolVar(&cargs.staging, "staging", false, "Restore into staging table, move into table only if all parts attached, else rollback")
+	flag.StringVar(&cargs.reportFile, "report", "", "Write JSON run report with per table and file results")
 	flag.Parse()
 
 	err := cargs.parseMode()
@@ -93,12 +156,51 @@ func main() {
 		println(err)
 		flag.Usage()
 		log.Println("Please check config file")
-		os.Exit(s.GetFinalStatus())
+		os.Exit(s.ExitCode())
 	}
 
 	c.TaskArgs.JobName = cargs.jobID
+	c.TaskArgs.Version = cliBackVer.GetVersion()
 	c.TaskArgs.JobPartition = cargs.partID
-	if len(cargs.backupType) > 0 && Contains([]string{"full", "diff", "incr", "part"}, cargs.backupType) {
+	c.TaskArgs.DataOnly = cargs.dataOnly
+	if cargs.staging {
+		c.ClickhouseRestoreOpts.StagingRestore = true
+	}
+	if len(cargs.onConflict) > 0 {
+		c.ClickhouseRestoreOpts.OnConflict = cargs.onConflict
+	}
+	if len(cargs.cluster) > 0 {
+		c.ClusterName = cargs.cluster
+	}
+	if len(cargs.reportFile) > 0 {
+		c.ReportFile = cargs.reportFile
+	}
+	if len(cargs.priority) > 0 {
+		c.RestorePriority = strings.Split(cargs.priority, ",")
+	}
+	if len(cargs.backupFilter) > 0 {
+		c.BackupFilter = backup.ParseFilter(cargs.backupFilter)
+	}
+	if len(cargs.restoreFilter) > 0 {
+		c.RestoreFilter = backup.ParseFilter(cargs.restoreFilter)
+	}
+	if len(cargs.exclude) > 0 {
+		excludes := backup.ParsePatterns(cargs.exclude)
+		c.BackupExclude = excludes
+		c.RestoreExclude = excludes
+	}
+	if len(cargs.restoreParts) > 0 {
+		c.RestorePartitions, err = config.ParsePartitionRules(cargs.restoreParts)
+		if err != nil {
+			println(err.Error())
+			flag.Usage()
+			log.Fatalf("Exit by error on parse cmd args")
+		}
+	}
+	if cargs.shard > 0 {
+		c.TaskArgs.ShardDir = backup.ShardDir(uint32(cargs.shard))
+	}
+	if len(cargs.backupType) > 0 && Contains([]string{"full", "diff", "incr", "part", "schema"}, cargs.backupType) {
 		c.TaskArgs.BackupType = cargs.backupType
 	} else {
 		c.TaskArgs.BackupType = "full"
@@ -106,7 +208,9 @@ func main() {
 	if c.WorkerPool.NumWorkers < 1 {
 		c.WorkerPool.NumWorkers = 8
 	}
-    if cargs.infoMode {
+	ctx := signalContext()
+	sftp_pool.New().SetContext(ctx)
+	if cargs.infoMode {
 		c.TaskArgs.JobType = config.Info
 		err = backup.Info()
 		if err != nil {
@@ -114,13 +218,19 @@ func main() {
 		}
 	} else if cargs.backupMode {
 		c.TaskArgs.JobType = config.Backup
-		err = backup.Backup()
+		err = backup.Backup(ctx)
 		if err != nil {
 			s.SetStatus(status.FailBackup)
 		}
+	} else if cargs.cleanupMode {
+		c.TaskArgs.JobType = config.Cleanup
+		err = backup.Cleanup(ctx, cargs.dryRun)
+		if err != nil {
+			s.SetStatus(status.FailCleanup)
+		}
 	} else if cargs.restoreMode {
 		c.TaskArgs.JobType = config.Restore
-		err = backup.Restore()
+		err = backup.Restore(ctx)
 		if err != nil {
 			s.SetStatus(status.FailRestore)
 		}
@@ -130,6 +240,17 @@ func main() {
 	if err != nil {
 		log.Println(err)
 	}
+	r := report.New()
+	r.JobName = c.TaskArgs.JobName
+	r.JobType = jobTypeName(c.TaskArgs.JobType)
+	if c.TaskArgs.JobType == config.Backup || c.TaskArgs.JobType == config.Restore {
+		log.Print("Results:\n" + r.Summary())
+	}
+	if len(c.ReportFile) > 0 {
+		if err := r.Write(c.ReportFile, s.GetFinalStatus()); err != nil {
+			log.Printf("Write report %s error: %v", c.ReportFile, err)
+		}
+	}
 	log.Printf("Exit %d", s.GetFinalStatus())
-	os.Exit(s.GetFinalStatus())
+	os.Exit(s.ExitCode())
 }
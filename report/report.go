@@ -0,0 +1,168 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// Outcome of backup/restore object
+const (
+	OutcomeOK        = "ok"
+	OutcomeFailed    = "failed"
+	OutcomeSkipped   = "skipped"
+	OutcomeCancelled = "cancelled"
+)
+
+// Result outcome of database, table (File empty) or file
+type Result struct {
+	Database string `json:"database"`
+	Table    string `json:"table,omitempty"`
+	File     string `json:"file,omitempty"`
+	Outcome  string `json:"outcome"`
+	Error    string `json:"error,omitempty"`
+	Retries  int    `json:"retries,omitempty"`
+}
+
+func (r Result) String() string {
+	obj := fmt.Sprintf("`%s`", r.Database)
+	if len(r.Table) > 0 {
+		obj += fmt.Sprintf(".`%s`", r.Table)
+	}
+	if len(r.File) > 0 {
+		obj += " " + r.File
+	}
+	out := fmt.Sprintf("%s %s", obj, r.Outcome)
+	if r.Retries > 0 {
+		out += fmt.Sprintf(" retries: %d", r.Retries)
+	}
+	if len(r.Error) > 0 {
+		out += ": " + r.Error
+	}
+	return out
+}
+
+type report struct {
+	mu       sync.Mutex
+	JobName  string         `json:"job_name"`
+	JobType  string         `json:"job_type"`
+	ExitCode int            `json:"exit_code"`
+	Files    map[string]int `json:"files"`  // files count by outcome
+	Tables   map[string]int `json:"tables"` // tables count by outcome
+	Results  []Result       `json:"results"`
+}
+
+var (
+	once     sync.Once
+	instance *report
+)
+
+func New() *report {
+	once.Do(func() {
+		instance = &report{
+			Files:  map[string]int{},
+			Tables: map[string]int{},
+		}
+	})
+	return instance
+}
+
+// Add store result, ok files are only counted
+func (r *report) Add(res Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case len(res.File) > 0:
+		r.Files[res.Outcome]++
+		if res.Outcome == OutcomeOK && res.Retries == 0 {
+			return
+		}
+	case len(res.Table) > 0:
+		r.Tables[res.Outcome]++
+	}
+	r.Results = append(r.Results, res)
+}
+
+// Error add failed result with error
+func (r *report) Error(db, table, file string, err error) {
+	res := Result{Database: db, Table: table, File: file, Outcome: OutcomeFailed}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.Add(res)
+}
+
+// Failed returns not ok results of table or file
+func (r *report) Failed(db, table string) []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var results []Result
+	for _, res := range r.Results {
+		if res.Outcome == OutcomeOK || res.Database != db || res.Table != table {
+			continue
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// Issues returns not ok results and retried files
+func (r *report) Issues() []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var results []Result
+	for _, res := range r.Results {
+		if res.Outcome == OutcomeOK && res.Retries == 0 {
+			continue
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// Summary returns counts and list of not ok objects
+func (r *report) Summary() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := fmt.Sprintf("tables: %s files: %s\n", counts(r.Tables), counts(r.Files))
+	for _, res := range r.Results {
+		if res.Outcome == OutcomeOK {
+			continue
+		}
+		out += "\t" + res.String() + "\n"
+	}
+	return out
+}
+
+// Write save run report as json
+func (r *report) Write(filename string, exitCode int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ExitCode = exitCode
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+func counts(m map[string]int) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out string
+	for _, k := range keys {
+		if len(out) > 0 {
+			out += ", "
+		}
+		out += fmt.Sprintf("%d %s", m[k], k)
+	}
+	if len(out) < 1 {
+		return "0"
+	}
+	return out
+}
@@ -0,0 +1,33 @@
+package report
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	r := &report{Files: map[string]int{}, Tables: map[string]int{}}
+	r.Add(Result{Database: "db", Table: "t", File: "all_1_1_0/data.bin", Outcome: OutcomeOK})
+	r.Add(Result{Database: "db", Table: "t", File: "all_1_1_0/data.mrk", Outcome: OutcomeOK, Retries: 2})
+	r.Error("db", "t", "all_1_1_0/primary.idx", errors.New("no such file"))
+	r.Add(Result{Database: "db", Table: "t", Outcome: OutcomeFailed})
+	r.Add(Result{Database: "db", Table: "t2", Outcome: OutcomeOK})
+
+	if r.Files[OutcomeOK] != 2 || r.Files[OutcomeFailed] != 1 {
+		t.Errorf("bad files count %v", r.Files)
+	}
+	if len(r.Results) != 4 {
+		t.Errorf("ok files without retries must not be stored, got %d results", len(r.Results))
+	}
+	failed := r.Failed("db", "t")
+	if len(failed) != 2 {
+		t.Fatalf("expect 2 failed, got %v", failed)
+	}
+	if failed[0].String() != "`db`.`t` all_1_1_0/primary.idx failed: no such file" {
+		t.Errorf("bad result string %s", failed[0])
+	}
+	if s := r.Summary(); s != "tables: 1 failed, 1 ok files: 1 failed, 2 ok\n"+
+		"\t`db`.`t` all_1_1_0/primary.idx failed: no such file\n\t`db`.`t` failed\n" {
+		t.Errorf("bad summary %q", s)
+	}
+}
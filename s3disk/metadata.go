@@ -0,0 +1,112 @@
+package s3disk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Object is one remote object referenced by Clickhouse metadata file
+type Object struct {
+	Size int64
+	Path string
+}
+
+// Metadata is local pointer file of Clickhouse object storage disk
+type Metadata struct {
+	Version   int
+	TotalSize int64
+	Objects   []Object
+	RefCount  int
+	ReadOnly  bool
+}
+
+var errBadMetadata = errors.New("Bad object disk metadata file")
+
+// ParseMetadata parse pointer file, versions 1-3 supported
+func ParseMetadata(r io.Reader) (*Metadata, error) {
+	sc := bufio.NewScanner(r)
+	var lines []string
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) < 2 {
+		return nil, errBadMetadata
+	}
+	m := new(Metadata)
+	var err error
+	if m.Version, err = strconv.Atoi(strings.TrimSpace(lines[0])); err != nil {
+		return nil, errBadMetadata
+	}
+	if m.Version < 1 || m.Version > 3 {
+		return nil, fmt.Errorf("Object disk metadata version %d not supported", m.Version)
+	}
+	head := strings.Split(lines[1], "\t")
+	if len(head) != 2 {
+		return nil, errBadMetadata
+	}
+	count, err := strconv.Atoi(head[0])
+	if err != nil {
+		return nil, errBadMetadata
+	}
+	if m.TotalSize, err = strconv.ParseInt(head[1], 10, 64); err != nil {
+		return nil, errBadMetadata
+	}
+	if len(lines) < 2+count+1 {
+		return nil, errBadMetadata
+	}
+	for _, l := range lines[2 : 2+count] {
+		obj := strings.SplitN(l, "\t", 2)
+		if len(obj) != 2 {
+			return nil, errBadMetadata
+		}
+		size, err := strconv.ParseInt(obj[0], 10, 64)
+		if err != nil {
+			return nil, errBadMetadata
+		}
+		m.Objects = append(m.Objects, Object{Size: size, Path: obj[1]})
+	}
+	if m.RefCount, err = strconv.Atoi(strings.TrimSpace(lines[2+count])); err != nil {
+		return nil, errBadMetadata
+	}
+	if m.Version >= 2 && len(lines) > 3+count {
+		m.ReadOnly = strings.TrimSpace(lines[3+count]) == "1"
+	}
+	return m, nil
+}
+
+// Bytes returns pointer file content in version 3 format
+func (m *Metadata) Bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "3\n%d\t%d\n", len(m.Objects), m.TotalSize)
+	for _, o := range m.Objects {
+		fmt.Fprintf(&b, "%d\t%s\n", o.Size, o.Path)
+	}
+	readOnly := 0
+	if m.ReadOnly {
+		readOnly = 1
+	}
+	fmt.Fprintf(&b, "%d\n%d\n", m.RefCount, readOnly)
+	return b.Bytes()
+}
+
+// RandomKey returns new object key in Clickhouse style
+func RandomKey() (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i := range buf {
+		buf[i] = letters[int(buf[i])%len(letters)]
+	}
+	return string(buf[:3]) + "/" + string(buf[3:]), nil
+}
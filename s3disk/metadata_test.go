@@ -0,0 +1,26 @@
+package s3disk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	content := "3\n2\t300\n100\tabc/qwertyuiopasdfghjklzxcvbnmqwe\n200\txyz/mnbvcxzlkjhgfdsapoiuytrewqmnb\n1\n0\n"
+	m, err := ParseMetadata(bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != 3 || m.TotalSize != 300 || len(m.Objects) != 2 || m.RefCount != 1 || m.ReadOnly {
+		t.Errorf("Bad metadata parsed: %+v", m)
+	}
+	if m.Objects[1].Size != 200 || m.Objects[1].Path != "xyz/mnbvcxzlkjhgfdsapoiuytrewqmnb" {
+		t.Errorf("Bad object parsed: %+v", m.Objects[1])
+	}
+	if string(m.Bytes()) != content {
+		t.Errorf("Bad metadata write:\n%s", m.Bytes())
+	}
+	if _, err := ParseMetadata(bytes.NewBufferString("3\n2\t300\n100\tabc\n")); err == nil {
+		t.Error("Truncated metadata must fail")
+	}
+}
@@ -0,0 +1,193 @@
+package s3disk
+
+import (
+	"cliback/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Client minimal S3 client for objects of Clickhouse s3 disk
+type Client struct {
+	endpoint  *url.URL
+	accessKey string
+	secretKey string
+	region    string
+	http      *http.Client
+}
+
+// New returns client for disk endpoint, same endpoint as in Clickhouse disk config
+func New(conf config.ObjectDisk) (*Client, error) {
+	if len(conf.Endpoint) < 1 {
+		return nil, errors.New("Object disk endpoint not set")
+	}
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	region := conf.Region
+	if len(region) < 1 {
+		region = "us-east-1"
+	}
+	return &Client{
+		endpoint:  u,
+		accessKey: conf.AccessKeyID,
+		secretKey: conf.SecretAccessKey,
+		region:    region,
+		http:      &http.Client{},
+	}, nil
+}
+
+func (cl *Client) objectURL(key string) *url.URL {
+	u := *cl.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(key, "/")
+	u.RawPath = ""
+	return &u
+}
+
+// Get returns object content reader
+func (cl *Client) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", cl.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	cl.sign(req, unsignedPayload)
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 GET %s: %s", key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Put upload object, size must be known
+func (cl *Client) Put(key string, body io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", cl.objectURL(key).String(), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	cl.sign(req, unsignedPayload)
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 PUT %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// Delete remove object, not existing object is not an error
+func (cl *Client) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", cl.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	cl.sign(req, unsignedPayload)
+	resp, err := cl.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("S3 DELETE %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// sign request by AWS Signature Version 4
+func (cl *Client) sign(req *http.Request, payloadHash string) {
+	if len(cl.accessKey) < 1 {
+		return
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	var query []string
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			query = append(query, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(query)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		strings.Join(query, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + cl.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+	key := hmacSHA256([]byte("AWS4"+cl.secretKey), date)
+	key = hmacSHA256(key, cl.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cl.accessKey, scope, signedHeaders, signature))
+}
+
+// Key returns object key relative to endpoint, old version 1 metadata keeps full path
+func (cl *Client) Key(m *Metadata, o Object) string {
+	if m.Version > 1 {
+		return o.Path
+	}
+	prefix := strings.TrimPrefix(cl.endpoint.Path, "/")
+	return strings.TrimPrefix(o.Path, prefix)
+}
@@ -2,9 +2,11 @@ package sftp_pool
 
 import (
 	"cliback/config"
+	"cliback/workerpool"
 	"container/list"
+	"context"
 	"errors"
-	"log"
+	"fmt"
 	"strconv"
 	"sync"
 	"time"
@@ -36,6 +38,7 @@ type SftpPool struct {
 	connOpened int
 	sshConfig  map[string]string
 	mux        sync.Mutex
+	ctx        context.Context
 }
 
 func New() *SftpPool {
@@ -54,6 +57,11 @@ func New() *SftpPool {
 	return sftpPoolInstance
 }
 
+// SetContext set job context, waiting for client stopped on its cancel
+func (sp *SftpPool) SetContext(ctx context.Context) {
+	sp.ctx = ctx
+}
+
 func (sp *SftpPool) SetMaxConn(maxConn int) {
 	sp.maxConn = maxConn
 }
@@ -98,16 +106,22 @@ func (sp *SftpPool) GetClient() (*sftp.Client, error) {
 	return sftpCli, nil
 }
 
+// GetClientLoop get client with worker_pool retry options
 func (sp *SftpPool) GetClientLoop() (*sftp.Client, error) {
-	for {
-		sftpClient, err := sp.GetClient()
+	var sftpClient *sftp.Client
+	ctx := sp.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	err := workerpool.Retry(ctx, func() error {
+		var err error
+		sftpClient, err = sp.GetClient()
 		if err != nil {
-			log.Printf("Error Get SFTP Client: %s", err)
-			time.Sleep(time.Second * 5)
-			continue
+			return fmt.Errorf("Error Get SFTP Client: %w", err)
 		}
-		return sftpClient, err
-	}
+		return nil
+	})
+	return sftpClient, err
 }
 
 func (sp *SftpPool) CheckConnection(sftpClient *sftp.Client) error {
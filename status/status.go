@@ -20,13 +20,15 @@ const (
 	FailRestoreFile       = 16
 	FailRestoreMeta       = 32
 	FailFreezeTable       = 64
-	FailGetIncrement      = 64
-	FailGetDBS            = 64
-	FailGetTables         = 64
-	FailClickhouseStorage = 64
+	FailCleanup           = 128
+	FailGetIncrement      = 256
+	FailGetDBS            = 512
+	FailGetTables         = 1024
+	FailClickhouseStorage = 2048
 )
 
 type status struct {
+	mux          sync.Mutex
 	FinalStatus  int
 	DetailStatus map[FailType]bool
 }
@@ -45,10 +47,14 @@ func New() *status {
 }
 
 func (s *status) SetStatus(failType FailType) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	s.DetailStatus[failType] = true
 }
 
 func (s *status) GetFinalStatus() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	result := 0
 	for k, v := range s.DetailStatus {
 		if v {
@@ -58,3 +64,17 @@ func (s *status) GetFinalStatus() int {
 	s.FinalStatus = result
 	return result
 }
+
+// ExitCode returns final status for process exit, statuses over exit code range are 255,
+// full status written into report file
+func (s *status) ExitCode() int {
+	result := s.GetFinalStatus()
+	if result > 255 {
+		return 255
+	}
+	return result
+}
+
+func (s *status) HasFails() bool {
+	return s.GetFinalStatus() != 0
+}
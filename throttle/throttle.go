@@ -0,0 +1,134 @@
+package throttle
+
+import (
+	"cliback/config"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter token bucket shared by all workers, nil Limiter is unlimited
+type Limiter struct {
+	mux    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+var (
+	onceRead    sync.Once
+	onceWrite   sync.Once
+	onceNetwork sync.Once
+	read        *Limiter
+	write       *Limiter
+	network     *Limiter
+)
+
+// NewLimiter returns limiter for bytes per second, nil for zero rate
+func NewLimiter(bytesPerSec int64) *Limiter {
+	if bytesPerSec < 1 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// Read limiter for shadow files reading
+func Read() *Limiter {
+	onceRead.Do(func() {
+		read = NewLimiter(config.New().Throttle.ReadBytesPerSec)
+	})
+	return read
+}
+
+// Write limiter for restored files writing into detached
+func Write() *Limiter {
+	onceWrite.Do(func() {
+		write = NewLimiter(config.New().Throttle.WriteBytesPerSec)
+	})
+	return write
+}
+
+// Network limiter for backup storage traffic
+func Network() *Limiter {
+	onceNetwork.Do(func() {
+		network = NewLimiter(config.New().BackupStorage.RateLimit)
+	})
+	return network
+}
+
+// Wait take n bytes, sleep while bucket in debt
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil || n < 1 {
+		return nil
+	}
+	l.mux.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mux.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewReader limit reading by all limiters
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (tr *reader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	for _, l := range tr.limiters {
+		if werr := l.Wait(tr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type writer struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter limit writing by all limiters
+func NewWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	return &writer{ctx: ctx, w: w, limiters: limiters}
+}
+
+func (tw *writer) Write(p []byte) (int, error) {
+	for _, l := range tw.limiters {
+		if err := l.Wait(tw.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return tw.w.Write(p)
+}
@@ -0,0 +1,47 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	const rate = 1 << 20
+	l := NewLimiter(rate)
+	start := time.Now()
+	// first second is burst, next half needs wait
+	n, err := io.Copy(ioutil.Discard, NewReader(context.Background(), bytes.NewReader(make([]byte, rate*3/2)), l))
+	if err != nil || n != rate*3/2 {
+		t.Fatalf("copy %d bytes, err %v", n, err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("limited copy took %s, expect about 500ms", d)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := NewLimiter(1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := NewWriter(ctx, ioutil.Discard, l)
+	if _, err := w.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("first write in burst: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 4096)); err != context.Canceled {
+		t.Errorf("expect cancel, got %v", err)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	if NewLimiter(0) != nil {
+		t.Errorf("zero rate must be unlimited")
+	}
+	var l *Limiter
+	if err := l.Wait(context.Background(), 1<<30); err != nil {
+		t.Error(err)
+	}
+}
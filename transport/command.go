@@ -1,8 +1,10 @@
 package transport
 
+import "context"
+
 type TransportCommand struct{}
 
-func (tc *TransportCommand) Do(file CliFile) (*TransportStat, error) {
+func (tc *TransportCommand) Do(ctx context.Context, file CliFile) (*TransportStat, error) {
 	panic("implement me")
 }
 
@@ -21,3 +23,7 @@ func (tc *TransportCommand) SearchMeta() ([]string, error) {
 func (tc *TransportCommand) DeleteBackup(backupName string) error {
 	panic("implement me")
 }
+
+func (tc *TransportCommand) FreeSpace() (int64, error) {
+	panic("implement me")
+}
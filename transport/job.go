@@ -3,12 +3,14 @@ package transport
 import (
 	"bytes"
 	"cliback/config"
+	"cliback/throttle"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io"
-	"log"
-	"os"
 	"path"
+	"strings"
 )
 
 // RunJobType backup or restore
@@ -29,43 +31,75 @@ type CliFile struct {
 	DBName     string
 	TableName  string
 	Reference  string
+	RefPath    string // db_dir/table_dir/name in reference backup, if differs
+	MTime      int64  // shadow file mtime, unix seconds, 0 for object disks
 	Shadow     string
 	Storage    string
+	Disk       string // restore target disk, chosen by storage policy
 	RunJobType RunJobType
 	TryRetry   bool
+	Retries    int
 	Sha1       string
 }
 
 // Archive returns archive file name
 func (cf *CliFile) Archive() string {
 	c := config.New()
+	if len(cf.Reference) > 0 && len(cf.RefPath) > 0 {
+		return path.Join(cf.Reference, c.TaskArgs.ShardDir, cf.RefPath+".gz")
+	}
 	if len(cf.Reference) > 0 {
-		return path.Join(cf.Reference, cf.DBName, cf.TableName, cf.Name+".gz")
+		return path.Join(cf.Reference, c.TaskArgs.ShardDir, cf.DBName, cf.TableName, cf.Name+".gz")
 	}
-	return path.Join(c.TaskArgs.JobName, cf.DBName, cf.TableName, cf.Name+".gz")
+	return path.Join(c.TaskArgs.JobName, c.TaskArgs.ShardDir, cf.DBName, cf.TableName, cf.Name+".gz")
 }
 
-///need refactor
-// RestoreDest returns restore path for table file
-func (cf *CliFile) RestoreDest() string {
+// RestoreStorage returns clickhouse storage name for restore, empty if storage not exists,
+// error if storage not exists and fail_if_storage_not_exists set
+func (cf *CliFile) RestoreStorage() (string, error) {
 	c := config.New()
+	if _, ok := c.ClickhouseStorage[cf.Disk]; ok && len(cf.Disk) > 0 {
+		return cf.Disk, nil
+	}
 	store := cf.Storage
 	if len(cf.Storage) < 1 {
 		store = "default"
 	}
-	if storagePath, ok := c.ClickhouseStorage[store]; ok {
-		return path.Join(storagePath, cf.Path, "detached", cf.Name)
+	if mapped, ok := c.ClickhouseRestoreOpts.DiskMap[store]; ok {
+		store = mapped
+	}
+	if _, ok := c.ClickhouseStorage[store]; ok {
+		return store, nil
 	}
 	if c.ClickhouseRestoreOpts.BadStorageToDefault {
-		store = "default"
-		if storagePath, ok := c.ClickhouseStorage[store]; ok {
-			return path.Join(storagePath, cf.Path, "detached", cf.Name)
+		if _, ok := c.ClickhouseStorage["default"]; ok {
+			return "default", nil
 		}
 	}
 	if c.ClickhouseRestoreOpts.FailIfStorageNotExists {
-		log.Fatal("ERR: Bad storage: ", store)
+		return "", fmt.Errorf("Bad storage: %s", store)
+	}
+	return "", nil
+}
+
+// RestoreDest returns restore path for table file
+func (cf *CliFile) RestoreDest() (string, error) {
+	c := config.New()
+	store, err := cf.RestoreStorage()
+	if err != nil || len(store) < 1 {
+		return "", err
+	}
+	return path.Join(c.ClickhouseStorage[store], cf.Path, "detached", cf.Name), nil
+}
+
+// RestorePartDir returns restore path for part dir of table file
+func (cf *CliFile) RestorePartDir() (string, error) {
+	c := config.New()
+	store, err := cf.RestoreStorage()
+	if err != nil || len(store) < 1 {
+		return "", err
 	}
-	return ""
+	return path.Join(c.ClickhouseStorage[store], cf.Path, "detached", strings.SplitN(cf.Name, "/", 2)[0]), nil
 }
 
 // BackupSrc returns full file path for backup
@@ -78,15 +112,15 @@ func (cf *CliFile) BackupSrcShort() string {
 	return path.Join(cf.Path, cf.Name)
 }
 
-// Sha1Compute compute sha1 for file
-func (cf *CliFile) Sha1Compute() error {
-	source, err := os.Open(cf.BackupSrc())
+// Sha1Compute compute sha1 for file, stopped on ctx cancel
+func (cf *CliFile) Sha1Compute(ctx context.Context) error {
+	source, err := cf.OpenSrc()
 	if err != nil {
 		return err
 	}
 	defer source.Close()
 	Sha1Sum := sha1.New()
-	_, err = io.Copy(Sha1Sum, source)
+	cf.Size, err = io.Copy(Sha1Sum, newCtxReader(ctx, throttle.NewReader(ctx, source, throttle.Read())))
 	if err != nil {
 		return err
 	}
@@ -108,10 +142,12 @@ type MetaFile struct {
 
 // Archive returns archive file path for metafile
 func (mf *MetaFile) Archive() string {
-	return path.Join(mf.JobName, mf.Path, mf.Name+".gz")
+	c := config.New()
+	return path.Join(mf.JobName, c.TaskArgs.ShardDir, mf.Path, mf.Name+".gz")
 }
 
 // SPath returns file path for old type metafile
 func (mf *MetaFile) SPath() string {
-	return path.Join(mf.JobName, mf.Path, mf.Name)
+	c := config.New()
+	return path.Join(mf.JobName, c.TaskArgs.ShardDir, mf.Path, mf.Name)
 }
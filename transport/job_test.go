@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"cliback/config"
+	"testing"
+)
+
+func TestRestoreStorageBad(t *testing.T) {
+	c := config.New()
+	defer func(storage map[string]string, opts config.ChMetaOpts) {
+		c.ClickhouseStorage, c.ClickhouseRestoreOpts = storage, opts
+	}(c.ClickhouseStorage, c.ClickhouseRestoreOpts)
+	c.ClickhouseStorage = map[string]string{"default": "/var/lib/clickhouse"}
+	c.ClickhouseRestoreOpts = config.ChMetaOpts{}
+
+	cf := CliFile{Name: "all_1_1_0/data.bin", Path: "data/db/t", Storage: "ssd"}
+	if dest, err := cf.RestoreDest(); err != nil || len(dest) > 0 {
+		t.Errorf("not existing storage dest %q, error %v, expect empty", dest, err)
+	}
+	c.ClickhouseRestoreOpts.FailIfStorageNotExists = true
+	if _, err := cf.RestoreDest(); err == nil {
+		t.Error("not existing storage must fail with fail_if_storage_not_exists")
+	}
+	c.ClickhouseRestoreOpts.BadStorageToDefault = true
+	dest, err := cf.RestoreDest()
+	if err != nil || dest != "/var/lib/clickhouse/data/db/t/detached/all_1_1_0/data.bin" {
+		t.Errorf("bad storage to default dest %q, error %v", dest, err)
+	}
+}
@@ -3,15 +3,20 @@ package transport
 import (
 	"bufio"
 	"cliback/config"
+	"cliback/throttle"
+	"cliback/workerpool"
 	"compress/gzip"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"sort"
+	"syscall"
 )
 
 type TransportLocal struct {
@@ -27,23 +32,26 @@ func MakeDirsRecurse(path string) error {
 	}
 	return nil
 }
-func (tl *TransportLocal) Do(file CliFile) (*TransportStat, error) {
+func (tl *TransportLocal) Do(ctx context.Context, file CliFile) (*TransportStat, error) {
 	switch file.RunJobType {
 	case Backup:
-		return tl.Backup(file)
+		return tl.Backup(ctx, file)
 	case Restore:
-		return tl.Restore(file)
+		return tl.Restore(ctx, file)
 	default:
 		return nil, errTransCreate
 	}
-	return nil, errTransCreate
 }
 
 // MakeBackupTransportLocal archive file and returns meta info
-func (tl *TransportLocal) Backup(file CliFile) (*TransportStat, error) {
+func (tl *TransportLocal) Backup(ctx context.Context, file CliFile) (*TransportStat, error) {
 	c := config.New()
 	t := new(TransportStat)
 	Sha1Sum := sha1.New()
+	// Not mounted storage must not be created on root fs
+	if _, err := os.Stat(c.BackupStorage.BackupDir); err != nil {
+		return t, workerpool.Permanent(fmt.Errorf("Backup dir not available: %v", err))
+	}
 	destFile := path.Join(c.BackupStorage.BackupDir, file.Archive())
 	err := MakeDirsRecurse(path.Dir(destFile))
 	if err != nil {
@@ -54,23 +62,19 @@ func (tl *TransportLocal) Backup(file CliFile) (*TransportStat, error) {
 		return nil, err
 	}
 	defer dest.Close()
-	source, err := os.Open(path.Join(file.BackupSrc()))
+	source, err := file.OpenSrc()
 	if err != nil {
 		return nil, err
 	}
 	defer source.Close()
-	gzw := gzip.NewWriter(dest)
+	gzw := gzip.NewWriter(throttle.NewWriter(ctx, dest, throttle.Network()))
 	defer gzw.Close()
 	mwr := io.MultiWriter(gzw, Sha1Sum)
-	_, err = io.Copy(mwr, source)
+	t.Size, err = io.Copy(mwr, newCtxReader(ctx, throttle.NewReader(ctx, source, throttle.Read())))
 	if err != nil {
 		return t, err
 	}
 	gzw.Flush()
-	s, err := source.Stat()
-	if err == nil {
-		t.Size = s.Size()
-	}
 	d, err := dest.Stat()
 	if err == nil {
 		t.BSize = d.Size()
@@ -80,16 +84,20 @@ func (tl *TransportLocal) Backup(file CliFile) (*TransportStat, error) {
 }
 
 // MakeRestoreTransportLocal restore file and returns meta info
-func (tl *TransportLocal) Restore(file CliFile) (*TransportStat, error) {
+func (tl *TransportLocal) Restore(ctx context.Context, file CliFile) (*TransportStat, error) {
 	c := config.New()
 	t := new(TransportStat)
 	Sha1Sum := sha1.New()
 
-	err := MakeDirsRecurse(path.Dir(file.RestoreDest()))
+	destFile, err := file.RestoreDest()
 	if err != nil {
 		return t, err
 	}
-	dest, err := os.Create(file.RestoreDest())
+	err = MakeDirsRecurse(path.Dir(destFile))
+	if err != nil {
+		return t, err
+	}
+	dest, err := file.CreateDest()
 	if err != nil {
 		return nil, err
 	}
@@ -101,14 +109,18 @@ func (tl *TransportLocal) Restore(file CliFile) (*TransportStat, error) {
 	}
 	defer source.Close()
 
-	gzr, err := gzip.NewReader(source)
+	gzr, err := gzip.NewReader(throttle.NewReader(ctx, source, throttle.Network()))
 	if err != nil {
 		return nil, err
 	}
 	defer gzr.Close()
-	mwr := io.MultiWriter(Sha1Sum, dest)
+	mwr := io.MultiWriter(Sha1Sum, throttle.NewWriter(ctx, dest, throttle.Write()))
 
-	_, err = io.Copy(mwr, gzr)
+	t.Size, err = io.Copy(mwr, newCtxReader(ctx, gzr))
+	if err != nil {
+		return t, err
+	}
+	err = dest.Close()
 	if err != nil {
 		return t, err
 	}
@@ -116,10 +128,6 @@ func (tl *TransportLocal) Restore(file CliFile) (*TransportStat, error) {
 	if err == nil {
 		t.BSize = s.Size()
 	}
-	d, err := dest.Stat()
-	if err == nil {
-		t.Size = d.Size()
-	}
 	t.Sha1Sum = hex.EncodeToString(Sha1Sum.Sum(nil))
 	return t, nil
 }
@@ -128,6 +136,10 @@ func (tl *TransportLocal) Restore(file CliFile) (*TransportStat, error) {
 func (tl *TransportLocal) WriteMeta(mf *MetaFile) error {
 	c := config.New()
 	sha1sum := sha1.New()
+	// Not mounted storage must not be created on root fs
+	if _, err := os.Stat(c.BackupStorage.BackupDir); err != nil {
+		return workerpool.Permanent(fmt.Errorf("Backup dir not available: %v", err))
+	}
 	source := bufio.NewReader(&mf.Content)
 	destFile := path.Join(c.BackupStorage.BackupDir, mf.Archive())
 	err := MakeDirsRecurse(path.Dir(destFile))
@@ -223,8 +235,31 @@ func (tl *TransportLocal) SearchMeta() ([]string, error) {
 	return backupNames, nil
 }
 
-// DeleteBackupLocal delete backup from archive
+// DeleteBackupLocal delete backup from archive, in cluster mode shard of backup
 func (tl *TransportLocal) DeleteBackup(backupName string) error {
 	c := config.New()
-	return os.RemoveAll(path.Join(c.BackupStorage.BackupDir, backupName))
+	jobDir := path.Join(c.BackupStorage.BackupDir, backupName)
+	if len(c.TaskArgs.ShardDir) < 1 {
+		return os.RemoveAll(jobDir)
+	}
+	err := os.RemoveAll(path.Join(jobDir, c.TaskArgs.ShardDir))
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(jobDir)
+	if err != nil || shardDirsLeft(files) {
+		return err
+	}
+	return os.RemoveAll(jobDir)
+}
+
+// FreeSpace returns free space of backup dir FS
+func (tl *TransportLocal) FreeSpace() (int64, error) {
+	c := config.New()
+	var st syscall.Statfs_t
+	err := syscall.Statfs(c.BackupStorage.BackupDir, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
 }
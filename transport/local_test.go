@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"cliback/config"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestDeleteBackupShard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := config.New()
+	defer func(backupDir, shardDir string) {
+		c.BackupStorage.BackupDir, c.TaskArgs.ShardDir = backupDir, shardDir
+	}(c.BackupStorage.BackupDir, c.TaskArgs.ShardDir)
+	c.BackupStorage.BackupDir = dir
+
+	job := "20210101_000000F"
+	for _, shard := range []string{"shard_1", "shard_2"} {
+		if err := os.MkdirAll(path.Join(dir, job, shard, "db"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tl := new(TransportLocal)
+	c.TaskArgs.ShardDir = "shard_1"
+	if err := tl.DeleteBackup(job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, job, "shard_1")); !os.IsNotExist(err) {
+		t.Errorf("shard_1 not deleted: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, job, "shard_2", "db")); err != nil {
+		t.Errorf("shard_2 of other shard deleted: %v", err)
+	}
+	c.TaskArgs.ShardDir = "shard_2"
+	if err := tl.DeleteBackup(job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dir, job)); !os.IsNotExist(err) {
+		t.Errorf("job dir not deleted with last shard: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package transport
+
+import (
+	"bytes"
+	"cliback/config"
+	"cliback/s3disk"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func objectDiskClient(storage string) (*s3disk.Client, error) {
+	c := config.New()
+	conf, ok := c.ObjectDisks[storage]
+	if !ok {
+		return nil, fmt.Errorf("Object disk %s connection not set in object_disks", storage)
+	}
+	return s3disk.New(conf)
+}
+
+// objectReader read remote objects of metadata file one by one
+type objectReader struct {
+	cli     *s3disk.Client
+	meta    *s3disk.Metadata
+	next    int
+	current io.ReadCloser
+}
+
+func (or *objectReader) Read(p []byte) (int, error) {
+	for {
+		if or.current == nil {
+			if or.next >= len(or.meta.Objects) {
+				return 0, io.EOF
+			}
+			obj := or.meta.Objects[or.next]
+			r, err := or.cli.Get(or.cli.Key(or.meta, obj))
+			if err != nil {
+				return 0, err
+			}
+			or.current = r
+			or.next++
+		}
+		n, err := or.current.Read(p)
+		if err == io.EOF {
+			or.current.Close()
+			or.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (or *objectReader) Close() error {
+	if or.current != nil {
+		return or.current.Close()
+	}
+	return nil
+}
+
+// objectMaxSize is size limit of one uploaded object, S3 rejects single PUT over 5 GiB
+var objectMaxSize int64 = 1 << 30
+
+// objectWriter upload file content as objects of up to objectMaxSize and write
+// metadata file on Close. Uploaded objects deleted if file not restored
+type objectWriter struct {
+	cli       *s3disk.Client
+	pw        *io.PipeWriter
+	done      chan error
+	remain    int64
+	objRemain int64
+	metaPath  string
+	meta      *s3disk.Metadata
+	closed    bool
+	err       error
+}
+
+// nextObject start upload of next object of file
+func (ow *objectWriter) nextObject() error {
+	key, err := s3disk.RandomKey()
+	if err != nil {
+		return err
+	}
+	size := ow.remain
+	if size > objectMaxSize {
+		size = objectMaxSize
+	}
+	ow.remain -= size
+	ow.objRemain = size
+	ow.meta.Objects = append(ow.meta.Objects, s3disk.Object{Size: size, Path: key})
+	pr, pw := io.Pipe()
+	ow.pw = pw
+	go func() {
+		err := ow.cli.Put(key, pr, size)
+		pr.CloseWithError(err)
+		ow.done <- err
+	}()
+	return nil
+}
+
+// finishObject close current object and wait upload result
+func (ow *objectWriter) finishObject() error {
+	if ow.pw == nil {
+		return nil
+	}
+	ow.pw.Close()
+	ow.pw = nil
+	return <-ow.done
+}
+
+// deleteObjects remove uploaded objects of not restored file
+func (ow *objectWriter) deleteObjects() {
+	for _, obj := range ow.meta.Objects {
+		if err := ow.cli.Delete(obj.Path); err != nil {
+			log.Printf("Delete object %s of %s error: %v", obj.Path, ow.metaPath, err)
+		}
+	}
+}
+
+func (ow *objectWriter) Write(p []byte) (int, error) {
+	written, err := ow.write(p)
+	if err != nil && ow.err == nil {
+		ow.err = err
+	}
+	return written, err
+}
+
+func (ow *objectWriter) write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if ow.pw == nil {
+			if ow.remain == 0 {
+				return written, errors.New("Restored file larger then backuped size")
+			}
+			if err := ow.nextObject(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if int64(len(chunk)) > ow.objRemain {
+			chunk = chunk[:ow.objRemain]
+		}
+		n, err := ow.pw.Write(chunk)
+		written += n
+		ow.objRemain -= int64(n)
+		if err != nil {
+			return written, err
+		}
+		if ow.objRemain == 0 {
+			if err := ow.finishObject(); err != nil {
+				return written, err
+			}
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (ow *objectWriter) Close() error {
+	if ow.closed {
+		return ow.err
+	}
+	ow.closed = true
+	err := ow.close()
+	if err != nil {
+		ow.deleteObjects()
+		if ow.err == nil {
+			ow.err = err
+		}
+	}
+	return ow.err
+}
+
+func (ow *objectWriter) close() error {
+	if ow.err != nil {
+		// failed write, current upload aborted
+		if ow.pw != nil {
+			ow.pw.CloseWithError(ow.err)
+			ow.pw = nil
+			<-ow.done
+		}
+		return ow.err
+	}
+	if err := ow.finishObject(); err != nil {
+		return err
+	}
+	if ow.remain > 0 {
+		return errors.New("Restored file smaller then backuped size")
+	}
+	return ioutil.WriteFile(ow.metaPath, ow.meta.Bytes(), 0644)
+}
+
+// OpenSrc returns backup source reader, remote objects read for object disks
+func (cf *CliFile) OpenSrc() (io.ReadCloser, error) {
+	c := config.New()
+	if !c.IsObjectDisk(cf.Storage) {
+		return os.Open(cf.BackupSrc())
+	}
+	cli, err := objectDiskClient(cf.Storage)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(cf.BackupSrc())
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s3disk.ParseMetadata(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cf.BackupSrc(), err)
+	}
+	return &objectReader{cli: cli, meta: meta}, nil
+}
+
+// CreateDest returns restore destination writer, for object disks content
+// uploaded as new objects and metadata file written to restore dest
+func (cf *CliFile) CreateDest() (io.WriteCloser, error) {
+	c := config.New()
+	storage, err := cf.RestoreStorage()
+	if err != nil {
+		return nil, err
+	}
+	dest, err := cf.RestoreDest()
+	if err != nil {
+		return nil, err
+	}
+	if !c.IsObjectDisk(storage) {
+		return os.Create(dest)
+	}
+	cli, err := objectDiskClient(storage)
+	if err != nil {
+		return nil, err
+	}
+	ow := &objectWriter{
+		cli:      cli,
+		done:     make(chan error, 1),
+		remain:   cf.Size,
+		metaPath: dest,
+		meta:     &s3disk.Metadata{TotalSize: cf.Size},
+	}
+	// first object started at once, empty file stored as one empty object
+	if err := ow.nextObject(); err != nil {
+		return nil, err
+	}
+	return ow, nil
+}
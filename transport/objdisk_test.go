@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"bytes"
+	"cliback/config"
+	"cliback/s3disk"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestObjectWriterSplit(t *testing.T) {
+	var mu sync.Mutex
+	puts := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		puts[r.URL.Path] = b
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(size int64) { objectMaxSize = size }(objectMaxSize)
+	objectMaxSize = 4
+
+	cli, err := s3disk.New(config.ObjectDisk{Endpoint: srv.URL + "/data/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("0123456789")
+	ow := &objectWriter{
+		cli:      cli,
+		done:     make(chan error, 1),
+		remain:   int64(len(content)),
+		metaPath: path.Join(dir, "data.bin"),
+		meta:     &s3disk.Metadata{TotalSize: int64(len(content))},
+	}
+	if err := ow.nextObject(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ow.Write(content[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ow.Write(content[3:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ow.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ow.meta.Objects) != 3 {
+		t.Fatalf("objects %d, want 3", len(ow.meta.Objects))
+	}
+	var got []byte
+	for i, obj := range ow.meta.Objects {
+		body := puts["/data/"+obj.Path]
+		if int64(len(body)) != obj.Size {
+			t.Errorf("object %d size %d, uploaded %d", i, obj.Size, len(body))
+		}
+		got = append(got, body...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("uploaded %q, want %q", got, content)
+	}
+	b, err := ioutil.ReadFile(ow.metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := s3disk.ParseMetadata(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.TotalSize != int64(len(content)) || len(meta.Objects) != 3 {
+		t.Errorf("metadata %+v", meta)
+	}
+}
+
+func TestObjectWriterDeleteOnFail(t *testing.T) {
+	var mu sync.Mutex
+	puts, deleted := 0, map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			puts++
+			if puts == 2 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		case http.MethodDelete:
+			deleted[r.URL.Path] = true
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "cliback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(size int64) { objectMaxSize = size }(objectMaxSize)
+	objectMaxSize = 4
+
+	cli, err := s3disk.New(config.ObjectDisk{Endpoint: srv.URL + "/data/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("0123456789")
+	newWriter := func(metaPath string) *objectWriter {
+		ow := &objectWriter{
+			cli:      cli,
+			done:     make(chan error, 1),
+			remain:   int64(len(content)),
+			metaPath: metaPath,
+			meta:     &s3disk.Metadata{TotalSize: int64(len(content))},
+		}
+		if err := ow.nextObject(); err != nil {
+			t.Fatal(err)
+		}
+		return ow
+	}
+	checkDeleted := func(ow *objectWriter) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, obj := range ow.meta.Objects {
+			if !deleted["/data/"+obj.Path] {
+				t.Errorf("object %s not deleted", obj.Path)
+			}
+		}
+	}
+
+	// second object upload failed midway
+	ow := newWriter(path.Join(dir, "data.bin"))
+	if _, err := ow.Write(content); err == nil {
+		t.Fatal("write must fail on failed upload")
+	}
+	if err := ow.Close(); err == nil {
+		t.Error("close must return write error")
+	}
+	checkDeleted(ow)
+	if _, err := os.Stat(ow.metaPath); !os.IsNotExist(err) {
+		t.Errorf("metadata of failed file written: %v", err)
+	}
+
+	// all objects uploaded, metadata not written
+	ow = newWriter(path.Join(dir, "not_exists", "data.bin"))
+	if _, err := ow.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := ow.Close(); err == nil {
+		t.Error("close must fail on metadata write")
+	}
+	checkDeleted(ow)
+}
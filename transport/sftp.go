@@ -4,12 +4,13 @@ import (
 	"bufio"
 	"cliback/config"
 	"cliback/sftp_pool"
+	"cliback/throttle"
 	"compress/gzip"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"io"
 	"log"
-	"os"
 	"path"
 	"sort"
 )
@@ -17,25 +18,24 @@ import (
 type TransportSFTP struct {
 }
 
-func (ts *TransportSFTP) Do(file CliFile) (*TransportStat, error) {
+func (ts *TransportSFTP) Do(ctx context.Context, file CliFile) (*TransportStat, error) {
 	switch file.RunJobType {
 	case Backup:
-		return ts.Backup(file)
+		return ts.Backup(ctx, file)
 	case Restore:
-		return ts.Restore(file)
+		return ts.Restore(ctx, file)
 	default:
 		return nil, errTransCreate
 	}
-	return nil, errTransCreate
 }
 
 // MakeBackupTransportSFTP archive file and returns meta info
-func (ts *TransportSFTP) Backup(file CliFile) (*TransportStat, error) {
+func (ts *TransportSFTP) Backup(ctx context.Context, file CliFile) (*TransportStat, error) {
 	c := config.New()
 	t := new(TransportStat)
 	Sha1Sum := sha1.New()
 	sp := sftp_pool.New()
-	sftpCli, err := sp.GetClientLoop()
+	sftpCli, err := sp.GetClient()
 	if err != nil {
 		return t, err
 	}
@@ -50,7 +50,7 @@ func (ts *TransportSFTP) Backup(file CliFile) (*TransportStat, error) {
 		return t, err
 	}
 	defer dest.Close()
-	source, err := os.Open(file.BackupSrc())
+	source, err := file.OpenSrc()
 	if err != nil {
 		return t, err
 	}
@@ -60,19 +60,16 @@ func (ts *TransportSFTP) Backup(file CliFile) (*TransportStat, error) {
 	gzw := gzip.NewWriter(pw)
 	mwr := io.MultiWriter(gzw, Sha1Sum)
 	go func() {
-		defer pw.Close()
+		var err error
+		defer func() { pw.CloseWithError(err) }()
 		defer gzw.Close()
-		io.Copy(mwr, source)
+		t.Size, err = io.Copy(mwr, newCtxReader(ctx, throttle.NewReader(ctx, source, throttle.Read())))
 		gzw.Flush()
 	}()
-	_, err = io.Copy(dest, pr)
+	_, err = io.Copy(dest, throttle.NewReader(ctx, pr, throttle.Network()))
 	if err != nil {
 		return t, err
 	}
-	s, err := source.Stat()
-	if err == nil {
-		t.Size = s.Size()
-	}
 	d, err := dest.Stat()
 	if err == nil {
 		t.BSize = d.Size()
@@ -82,24 +79,27 @@ func (ts *TransportSFTP) Backup(file CliFile) (*TransportStat, error) {
 }
 
 // MakeRestoreTransportSFTP restore file and returns meta info
-func (ts *TransportSFTP) Restore(file CliFile) (*TransportStat, error) {
+func (ts *TransportSFTP) Restore(ctx context.Context, file CliFile) (*TransportStat, error) {
 	c := config.New()
 	t := new(TransportStat)
 	Sha1Sum := sha1.New()
 
-	destFile := path.Join(file.RestoreDest())
-	err := MakeDirsRecurse(path.Dir(destFile))
+	destFile, err := file.RestoreDest()
 	if err != nil {
 		return t, err
 	}
-	dest, err := os.Create(destFile)
+	err = MakeDirsRecurse(path.Dir(destFile))
+	if err != nil {
+		return t, err
+	}
+	dest, err := file.CreateDest()
 	if err != nil {
 		return t, err
 	}
 	defer dest.Close()
 
 	sp := sftp_pool.New()
-	sftpCli, err := sp.GetClientLoop()
+	sftpCli, err := sp.GetClient()
 	if err != nil {
 		return t, err
 	}
@@ -110,13 +110,17 @@ func (ts *TransportSFTP) Restore(file CliFile) (*TransportStat, error) {
 	}
 	defer source.Close()
 
-	gzr, err := gzip.NewReader(source)
+	gzr, err := gzip.NewReader(throttle.NewReader(ctx, source, throttle.Network()))
 	if err != nil {
 		return t, err
 	}
 	defer gzr.Close()
-	mwr := io.MultiWriter(Sha1Sum, dest)
-	_, err = io.Copy(mwr, gzr)
+	mwr := io.MultiWriter(Sha1Sum, throttle.NewWriter(ctx, dest, throttle.Write()))
+	t.Size, err = io.Copy(mwr, newCtxReader(ctx, gzr))
+	if err != nil {
+		return t, err
+	}
+	err = dest.Close()
 	if err != nil {
 		return t, err
 	}
@@ -124,10 +128,6 @@ func (ts *TransportSFTP) Restore(file CliFile) (*TransportStat, error) {
 	if err == nil {
 		t.BSize = s.Size()
 	}
-	d, err := dest.Stat()
-	if err == nil {
-		t.Size = d.Size()
-	}
 	t.Sha1Sum = hex.EncodeToString(Sha1Sum.Sum(nil))
 	return t, nil
 }
@@ -258,7 +258,7 @@ func (ts *TransportSFTP) SearchMeta() ([]string, error) {
 	return bnames, nil
 }
 
-// DeleteBackupSFTP delete backup from archive
+// DeleteBackupSFTP delete backup from archive, in cluster mode shard of backup
 func (ts *TransportSFTP) DeleteBackup(backupName string) error {
 	c := config.New()
 	sp := sftp_pool.New()
@@ -267,5 +267,33 @@ func (ts *TransportSFTP) DeleteBackup(backupName string) error {
 		return err
 	}
 	defer sp.ReleaseClient(sftpCli)
-	return sftp_pool.RemoveDirectoryRecursive(sftpCli, path.Join(c.BackupStorage.BackupDir, backupName))
+	jobDir := path.Join(c.BackupStorage.BackupDir, backupName)
+	if len(c.TaskArgs.ShardDir) < 1 {
+		return sftp_pool.RemoveDirectoryRecursive(sftpCli, jobDir)
+	}
+	err = sftp_pool.RemoveDirectoryRecursive(sftpCli, path.Join(jobDir, c.TaskArgs.ShardDir))
+	if err != nil {
+		return err
+	}
+	files, err := sftpCli.ReadDir(jobDir)
+	if err != nil || shardDirsLeft(files) {
+		return err
+	}
+	return sftp_pool.RemoveDirectoryRecursive(sftpCli, jobDir)
+}
+
+// FreeSpace returns free space of backup dir by statvfs extension
+func (ts *TransportSFTP) FreeSpace() (int64, error) {
+	c := config.New()
+	sp := sftp_pool.New()
+	sftpCli, err := sp.GetClientLoop()
+	if err != nil {
+		return 0, err
+	}
+	defer sp.ReleaseClient(sftpCli)
+	st, err := sftpCli.StatVFS(c.BackupStorage.BackupDir)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Frsize * st.Bavail), nil
 }
@@ -2,8 +2,12 @@ package transport
 
 import (
 	"cliback/config"
+	"context"
 	"errors"
+	"io"
+	"os"
 	"regexp"
+	"strings"
 )
 
 var (
@@ -12,11 +16,12 @@ var (
 )
 
 type Transport interface {
-	Do(file CliFile) (*TransportStat, error)
+	Do(ctx context.Context, file CliFile) (*TransportStat, error)
 	ReadMeta(mf *MetaFile) error
 	WriteMeta(mf *MetaFile) error
 	SearchMeta() ([]string, error)
 	DeleteBackup(backupName string) error
+	FreeSpace() (int64, error)
 }
 
 // Transport for backup/restore files
@@ -46,8 +51,36 @@ func MakeTransport() (Transport, error) {
 }
 
 func metaDirNameMatched(metaDirName string) bool {
-	if reMatch, _ := regexp.MatchString("^(\\d{8}_\\d{6}[FDIP]{1})$", metaDirName); reMatch {
+	if reMatch, _ := regexp.MatchString("^(\\d{8}_\\d{6}[FDIPS]{1})$", metaDirName); reMatch {
 		return true
 	}
 	return false
 }
+
+// shardDirsLeft tells whether cluster job dir has shard sub dirs,
+// job dir deleted with last shard only
+func shardDirsLeft(files []os.FileInfo) bool {
+	for _, f := range files {
+		if f.IsDir() && strings.HasPrefix(f.Name(), "shard_") {
+			return true
+		}
+	}
+	return false
+}
+
+// ctxReader stop copy when context cancelled, so in-flight file is aborted
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newCtxReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
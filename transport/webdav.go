@@ -3,18 +3,23 @@ package transport
 import (
 	"bufio"
 	"cliback/config"
+	"cliback/throttle"
 	"compress/gzip"
+	"context"
 	"crypto/sha1"
 	"crypto/tls"
 	"encoding/hex"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"github.com/studio-b12/gowebdav"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"path"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -56,20 +61,19 @@ func getConnectLink() string {
 	link += fmt.Sprintf("%s:%d", c.BackupStorage.BackupConn.HostName, c.BackupStorage.BackupConn.Port)
 	return link
 }
-func (twd *TransportWebDav) Do(file CliFile) (*TransportStat, error) {
+func (twd *TransportWebDav) Do(ctx context.Context, file CliFile) (*TransportStat, error) {
 	switch file.RunJobType {
 	case Backup:
-		return twd.Backup(file)
+		return twd.Backup(ctx, file)
 	case Restore:
-		return twd.Restore(file)
+		return twd.Restore(ctx, file)
 	default:
 		return nil, errTransCreate
 	}
-	return nil, errTransCreate
 }
 
 // MakeBackupTransportLocal archive file and returns meta info
-func (twd *TransportWebDav) Backup(file CliFile) (*TransportStat, error) {
+func (twd *TransportWebDav) Backup(ctx context.Context, file CliFile) (*TransportStat, error) {
 	c := config.New()
 	t := new(TransportStat)
 	Sha1Sum := sha1.New()
@@ -86,7 +90,7 @@ func (twd *TransportWebDav) Backup(file CliFile) (*TransportStat, error) {
 			return t, err
 		}
 	}
-	source, err := os.Open(file.BackupSrc())
+	source, err := file.OpenSrc()
 	if err != nil {
 		return t, err
 	}
@@ -97,19 +101,16 @@ func (twd *TransportWebDav) Backup(file CliFile) (*TransportStat, error) {
 	gzw := gzip.NewWriter(pw)
 	mwr := io.MultiWriter(gzw, Sha1Sum)
 	go func() {
-		defer pw.Close()
+		var err error
+		defer func() { pw.CloseWithError(err) }()
 		defer gzw.Close()
-		io.Copy(mwr, source)
+		t.Size, err = io.Copy(mwr, newCtxReader(ctx, throttle.NewReader(ctx, source, throttle.Read())))
 		gzw.Flush()
 	}()
-	err = wdCli.WriteStream(destFile, pr, 0644)
+	err = wdCli.WriteStream(destFile, throttle.NewReader(ctx, pr, throttle.Network()), 0644)
 	if err != nil {
 		return t, err
 	}
-	s, err := source.Stat()
-	if err == nil {
-		t.Size = s.Size()
-	}
 	d, err := wdCli.Stat(destFile)
 	if err == nil {
 		t.BSize = d.Size()
@@ -119,17 +120,20 @@ func (twd *TransportWebDav) Backup(file CliFile) (*TransportStat, error) {
 }
 
 // MakeRestoreTransportLocal restore file and returns meta info
-func (twd *TransportWebDav) Restore(file CliFile) (*TransportStat, error) {
+func (twd *TransportWebDav) Restore(ctx context.Context, file CliFile) (*TransportStat, error) {
 	c := config.New()
 	t := new(TransportStat)
 	Sha1Sum := sha1.New()
 
-	destFile := path.Join(file.RestoreDest())
-	err := MakeDirsRecurse(path.Dir(destFile))
+	destFile, err := file.RestoreDest()
 	if err != nil {
 		return t, err
 	}
-	dest, err := os.Create(destFile)
+	err = MakeDirsRecurse(path.Dir(destFile))
+	if err != nil {
+		return t, err
+	}
+	dest, err := file.CreateDest()
 	if err != nil {
 		return t, err
 	}
@@ -146,13 +150,17 @@ func (twd *TransportWebDav) Restore(file CliFile) (*TransportStat, error) {
 	}
 	defer source.Close()
 
-	gzr, err := gzip.NewReader(source)
+	gzr, err := gzip.NewReader(throttle.NewReader(ctx, source, throttle.Network()))
 	if err != nil {
 		return t, err
 	}
 	defer gzr.Close()
-	mwr := io.MultiWriter(Sha1Sum, dest)
-	_, err = io.Copy(mwr, gzr)
+	mwr := io.MultiWriter(Sha1Sum, throttle.NewWriter(ctx, dest, throttle.Write()))
+	t.Size, err = io.Copy(mwr, newCtxReader(ctx, gzr))
+	if err != nil {
+		return t, err
+	}
+	err = dest.Close()
 	if err != nil {
 		return t, err
 	}
@@ -160,10 +168,6 @@ func (twd *TransportWebDav) Restore(file CliFile) (*TransportStat, error) {
 	if err == nil {
 		t.BSize = s.Size()
 	}
-	d, err := dest.Stat()
-	if err == nil {
-		t.Size = d.Size()
-	}
 	t.Sha1Sum = hex.EncodeToString(Sha1Sum.Sum(nil))
 	return t, nil
 }
@@ -299,6 +303,7 @@ func (twd *TransportWebDav) SearchMeta() ([]string, error) {
 	return bnames, nil
 }
 
+// DeleteBackup delete backup from archive, in cluster mode shard of backup
 func (twd *TransportWebDav) DeleteBackup(backupName string) error {
 	c := config.New()
 	wdCli := GetWDCli()
@@ -306,5 +311,57 @@ func (twd *TransportWebDav) DeleteBackup(backupName string) error {
 	if err != nil {
 		return err
 	}
-	return wdCli.RemoveAll(path.Join(c.BackupStorage.BackupDir, backupName))
+	jobDir := path.Join(c.BackupStorage.BackupDir, backupName)
+	if len(c.TaskArgs.ShardDir) < 1 {
+		return wdCli.RemoveAll(jobDir)
+	}
+	err = wdCli.RemoveAll(path.Join(jobDir, c.TaskArgs.ShardDir))
+	if err != nil {
+		return err
+	}
+	files, err := wdCli.ReadDir(jobDir)
+	if err != nil || shardDirsLeft(files) {
+		return err
+	}
+	return wdCli.RemoveAll(jobDir)
+}
+
+type wdQuotaResponse struct {
+	Available []string `xml:"response>propstat>prop>quota-available-bytes"`
+}
+
+// FreeSpace returns quota-available-bytes of backup dir (RFC 4331)
+func (twd *TransportWebDav) FreeSpace() (int64, error) {
+	c := config.New()
+	body := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/></D:prop></D:propfind>`
+	req, err := http.NewRequest("PROPFIND", getConnectLink()+path.Join("/", c.BackupStorage.BackupDir), strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.SetBasicAuth(c.BackupStorage.BackupConn.UserName, c.BackupStorage.BackupConn.Password)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+	tr := &http.Transport{TLSHandshakeTimeout: 10 * time.Second}
+	if c.BackupStorage.BackupConn.Secure && c.BackupStorage.BackupConn.SkipVerify {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	resp, err := (&http.Client{Transport: tr, Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return 0, fmt.Errorf("WebDAV PROPFIND quota: %s", resp.Status)
+	}
+	var qr wdQuotaResponse
+	err = xml.NewDecoder(resp.Body).Decode(&qr)
+	if err != nil {
+		return 0, err
+	}
+	for _, a := range qr.Available {
+		if n, err := strconv.ParseInt(strings.TrimSpace(a), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, errors.New("WebDAV server not returns quota-available-bytes")
 }
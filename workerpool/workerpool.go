@@ -1,7 +1,11 @@
 package workerpool
 
 import (
+	"cliback/config"
+	"context"
+	"errors"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 )
@@ -17,17 +21,64 @@ func (f TaskFunc) Run(x interface{}) (interface{}, error) {
 	return f(x)
 }
 
+// Result of job after all retries
+type Result struct {
+	Job     TaskElem
+	Value   interface{}
+	Err     error
+	Retries int
+}
+
+// permanentError is not retried
+type permanentError struct {
+	err error
+}
+
+func (pe *permanentError) Error() string {
+	return pe.err.Error()
+}
+
+func (pe *permanentError) Unwrap() error {
+	return pe.err
+}
+
+// Permanent mark error as not retryable
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent tells whether error marked by Permanent
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+// DefaultRetryable retry all errors except permanent and context errors
+func DefaultRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return !IsPermanent(err)
+}
+
 type WorkerPool struct {
+	ctx         context.Context
 	task        Task
 	jobsChan    chan TaskElem
-	resultsChan chan TaskElem
+	resultsChan chan Result
 	numWorkers  int
 	numRetry    int
-	needRetry   bool
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	retryable   func(error) bool
 	wg          sync.WaitGroup
 }
 
-func MakeWorkerPool(t Task, numWorkers, numRetry, chanLen int) *WorkerPool {
+// MakeWorkerPool pool stop retries when ctx cancelled, task must check ctx itself
+func MakeWorkerPool(ctx context.Context, t Task, numWorkers, numRetry, chanLen int) *WorkerPool {
 	if numWorkers < 1 {
 		numWorkers = 8
 	}
@@ -38,41 +89,110 @@ func MakeWorkerPool(t Task, numWorkers, numRetry, chanLen int) *WorkerPool {
 		chanLen = numWorkers * 2
 	}
 	return &WorkerPool{
+		ctx:         ctx,
 		task:        t,
 		jobsChan:    make(chan TaskElem, chanLen),
-		resultsChan: make(chan TaskElem, chanLen),
+		resultsChan: make(chan Result, chanLen),
 		numWorkers:  numWorkers,
 		numRetry:    numRetry,
+		baseDelay:   time.Second,
+		maxDelay:    time.Minute,
+		retryable:   DefaultRetryable,
 		wg:          sync.WaitGroup{},
 	}
 }
 
+// SetBackoff set first retry delay, delay doubled on every retry up to max
+func (wp *WorkerPool) SetBackoff(base, max time.Duration) {
+	if base > 0 {
+		wp.baseDelay = base
+	}
+	if max >= wp.baseDelay {
+		wp.maxDelay = max
+	}
+}
+
+// SetRetryable set errors classifier, not retryable errors returned at once
+func (wp *WorkerPool) SetRetryable(f func(error) bool) {
+	wp.retryable = f
+}
+
 func (wp *WorkerPool) GetJobsChan() chan<- TaskElem {
 	return wp.jobsChan
 }
-func (wp *WorkerPool) GetResultsChan() <-chan TaskElem {
+func (wp *WorkerPool) GetResultsChan() <-chan Result {
 	return wp.resultsChan
 }
 
+// backoff exponential delay with jitter in [delay/2, delay]
+func (wp *WorkerPool) backoff(retry int) time.Duration {
+	delay := wp.baseDelay
+	for i := 1; i < retry && delay < wp.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > wp.maxDelay {
+		delay = wp.maxDelay
+	}
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func (wp *WorkerPool) sleep(d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-wp.ctx.Done():
+	case <-t.C:
+	}
+}
+
 func (wp *WorkerPool) workerFunc(id int) {
 	defer wp.wg.Done()
 	for job := range wp.jobsChan {
-		jobComplete := false
-		var jobResult TaskElem
-		var err error
-		for !jobComplete {
-			jobResult, err = wp.task.Run(job)
-			if wp.needRetry && err != nil {
-				log.Print("Job is fail", err)
-				time.Sleep(2 * time.Second)
-				continue
+		res := Result{Job: job}
+		for {
+			res.Value, res.Err = wp.task.Run(job)
+			if res.Err == nil || res.Retries >= wp.numRetry ||
+				wp.ctx.Err() != nil || !wp.retryable(res.Err) {
+				break
 			}
-			jobComplete = true
+			res.Retries++
+			delay := wp.backoff(res.Retries)
+			log.Printf("Job is fail: %v. Retry %d/%d after %s", res.Err, res.Retries, wp.numRetry, delay.Round(time.Millisecond))
+			wp.sleep(delay)
 		}
-		wp.resultsChan <- jobResult
+		wp.resultsChan <- res
 	}
 }
 
+// Retry run f with retries and backoff of pool, returns last error.
+// Permanent errors not retried, waiting stopped by ctx cancel
+func (wp *WorkerPool) Retry(f func() error) error {
+	for retry := 1; ; retry++ {
+		err := f()
+		if err == nil || retry > wp.numRetry || !wp.retryable(err) {
+			return err
+		}
+		if wp.ctx.Err() != nil {
+			return wp.ctx.Err()
+		}
+		delay := wp.backoff(retry)
+		log.Printf("%v. Retry %d/%d after %s", err, retry, wp.numRetry, delay.Round(time.Millisecond))
+		wp.sleep(delay)
+		if wp.ctx.Err() != nil {
+			return wp.ctx.Err()
+		}
+	}
+}
+
+// Retry run single call f with worker_pool retry options of config
+func Retry(ctx context.Context, f func() error) error {
+	c := config.New()
+	wp := MakeWorkerPool(ctx, nil, 1, c.WorkerPool.NumRetry, 1)
+	wp.SetBackoff(time.Duration(c.WorkerPool.RetryDelay)*time.Second, time.Duration(c.WorkerPool.RetryMaxDelay)*time.Second)
+	return wp.Retry(f)
+}
+
 func (wp *WorkerPool) waitFunc() {
 	wp.wg.Wait()
 	close(wp.resultsChan)
@@ -85,30 +205,3 @@ func (wp *WorkerPool) Start() {
 	}
 	go wp.waitFunc()
 }
-
-//func RunJobs(files []CliFile, jobsChan chan<- CliFile){
-//	for _,file := range (files){
-//		jobsChan <- file
-//	}
-//	close(jobsChan)
-//}
-
-//func main() {
-//	const numJobs = 5
-//	const numRetry = 3
-//	jobs := make(chan CliFile, numJobs)
-//	results := make(chan CliFile, numJobs)
-//	wg := sync.WaitGroup{}
-//	var wp = WorkerPool{jobs,results,numJobs,numRetry, wg}
-//	var files []CliFile
-//
-//	for i := 0; i<1000; i++{
-//		files=append(files, CliFile{name:"a",count:i,result:0})
-//	}
-//	wp.Start()
-//	go RunJobs(files,jobs)
-//
-//	for job := range(results){
-//		fmt.Println(job.worker_id,job.count,job.result)
-//	}
-//}
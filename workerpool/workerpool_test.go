@@ -0,0 +1,96 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	errTemp := errors.New("temporary")
+	errFatal := errors.New("fatal")
+	calls := map[int]int{}
+	var task TaskFunc = func(i interface{}) (interface{}, error) {
+		n := i.(int)
+		calls[n]++
+		switch {
+		case n == 1 && calls[n] < 3:
+			return nil, errTemp
+		case n == 2:
+			return nil, errTemp
+		case n == 3:
+			return nil, Permanent(errFatal)
+		}
+		return n * 10, nil
+	}
+	wp := MakeWorkerPool(context.Background(), task, 1, 3, 4)
+	wp.SetBackoff(time.Millisecond, 4*time.Millisecond)
+	wp.Start()
+	for i := 0; i < 4; i++ {
+		wp.GetJobsChan() <- i
+	}
+	close(wp.GetJobsChan())
+	results := map[int]Result{}
+	for res := range wp.GetResultsChan() {
+		results[res.Job.(int)] = res
+	}
+	if r := results[0]; r.Err != nil || r.Value != 0 || r.Retries != 0 {
+		t.Errorf("job 0: %+v", r)
+	}
+	if r := results[1]; r.Err != nil || r.Value != 10 || r.Retries != 2 {
+		t.Errorf("job 1 must succeed after 2 retries: %+v", r)
+	}
+	if r := results[2]; r.Err != errTemp || r.Retries != 3 {
+		t.Errorf("job 2 must fail after 3 retries: %+v", r)
+	}
+	if r := results[3]; !errors.Is(r.Err, errFatal) || r.Retries != 0 {
+		t.Errorf("job 3 permanent error must not be retried: %+v", r)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	wp := MakeWorkerPool(context.Background(), nil, 1, 1, 1)
+	wp.SetBackoff(time.Second, 10*time.Second)
+	for retry, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second} {
+		d := wp.backoff(retry)
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%d) = %s, expect in [%s, %s]", retry, d, max/2, max)
+		}
+	}
+}
+
+func TestRetryCall(t *testing.T) {
+	errTemp := errors.New("temporary")
+	wp := MakeWorkerPool(context.Background(), nil, 1, 2, 1)
+	wp.SetBackoff(time.Millisecond, 2*time.Millisecond)
+	calls := 0
+	err := wp.Retry(func() error {
+		calls++
+		return errTemp
+	})
+	if err != errTemp || calls != 3 {
+		t.Errorf("Retry: %v after %d calls, expect 3 calls", err, calls)
+	}
+	calls = 0
+	err = wp.Retry(func() error {
+		calls++
+		return Permanent(errTemp)
+	})
+	if !errors.Is(err, errTemp) || calls != 1 {
+		t.Errorf("permanent error retried: %d calls", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wp = MakeWorkerPool(ctx, nil, 1, 100, 1)
+	wp.SetBackoff(time.Hour, time.Hour)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err = wp.Retry(func() error { return errTemp })
+	if err != context.Canceled || time.Since(start) > time.Second {
+		t.Errorf("cancelled Retry: %v after %s", err, time.Since(start))
+	}
+}